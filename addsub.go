@@ -0,0 +1,76 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the 256 bit addition and subtraction used by the rotors.
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// addBlockGeneric adds key to blk, treating both as 256 bit little-endian
+// numbers held in four 64 bit limbs.  The carry out of the last limb is
+// discarded, so the result is the same as adding them one byte at a time.
+func addBlockGeneric(blk, key *[CipherBlockBytes]byte) {
+	var sum, carry uint64
+	for i := 0; i < CipherBlockBytes; i += 8 {
+		sum, carry = bits.Add64(binary.LittleEndian.Uint64(blk[i:]), binary.LittleEndian.Uint64(key[i:]), carry)
+		binary.LittleEndian.PutUint64(blk[i:], sum)
+	}
+}
+
+// subBlockGeneric subtracts key from blk, treating both as 256 bit
+// little-endian numbers held in four 64 bit limbs.  The borrow out of the
+// last limb is discarded.
+func subBlockGeneric(blk, key *[CipherBlockBytes]byte) {
+	var diff, borrow uint64
+	for i := 0; i < CipherBlockBytes; i += 8 {
+		diff, borrow = bits.Sub64(binary.LittleEndian.Uint64(blk[i:]), binary.LittleEndian.Uint64(key[i:]), borrow)
+		binary.LittleEndian.PutUint64(blk[i:], diff)
+	}
+}
+
+// addShort handles a short (final) block by copying it into a zero padded
+// 32 byte block.  Since carries only move towards the higher bytes, the first
+// len(blk) bytes of the result are the same as those from adding one byte at
+// a time.
+func addShort(blk, key CipherBlock) {
+	var b, k [CipherBlockBytes]byte
+	copy(b[:], blk)
+	copy(k[:], key[:len(blk)])
+	addBlock256(&b, &k)
+	copy(blk, b[:])
+}
+
+// subShort handles a short (final) block in the same way as addShort.
+func subShort(blk, key CipherBlock) {
+	var b, k [CipherBlockBytes]byte
+	copy(b[:], blk)
+	copy(k[:], key[:len(blk)])
+	subBlock256(&b, &k)
+	copy(blk, b[:])
+}
+
+// addLong adds key to a block longer than CipherBlockBytes one byte at a time,
+// carrying through every byte of blk.
+func addLong(blk, key CipherBlock) {
+	var p int
+	for idx, val := range blk {
+		p += int(val) + int(key[idx])
+		blk[idx] = byte(p & 0xFF)
+		p >>= BitsPerByte
+	}
+}
+
+// subLong subtracts key from a block longer than CipherBlockBytes one byte at
+// a time, borrowing through every byte of blk.
+func subLong(blk, key CipherBlock) {
+	var p int
+	for idx, val := range blk {
+		p = p + int(val) - int(key[idx])
+		blk[idx] = byte(p & 0xFF)
+		p >>= BitsPerByte
+	}
+}
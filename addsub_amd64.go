@@ -0,0 +1,18 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+//go:build amd64 && !purego
+
+package tnt2engine
+
+// addBlock256 adds key to blk as 256 bit little-endian numbers using the
+// ADD/ADC instructions.
+//
+//go:noescape
+func addBlock256(blk, key *[CipherBlockBytes]byte)
+
+// subBlock256 subtracts key from blk as 256 bit little-endian numbers using
+// the SUB/SBB instructions.
+//
+//go:noescape
+func subBlock256(blk, key *[CipherBlockBytes]byte)
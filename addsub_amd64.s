@@ -0,0 +1,34 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+//go:build amd64 && !purego
+
+#include "textflag.h"
+
+// func addBlock256(blk, key *[CipherBlockBytes]byte)
+TEXT ·addBlock256(SB), NOSPLIT, $0-16
+	MOVQ blk+0(FP), DI
+	MOVQ key+8(FP), SI
+	MOVQ 0(SI), AX
+	ADDQ AX, 0(DI)
+	MOVQ 8(SI), AX
+	ADCQ AX, 8(DI)
+	MOVQ 16(SI), AX
+	ADCQ AX, 16(DI)
+	MOVQ 24(SI), AX
+	ADCQ AX, 24(DI)
+	RET
+
+// func subBlock256(blk, key *[CipherBlockBytes]byte)
+TEXT ·subBlock256(SB), NOSPLIT, $0-16
+	MOVQ blk+0(FP), DI
+	MOVQ key+8(FP), SI
+	MOVQ 0(SI), AX
+	SUBQ AX, 0(DI)
+	MOVQ 8(SI), AX
+	SBBQ AX, 8(DI)
+	MOVQ 16(SI), AX
+	SBBQ AX, 16(DI)
+	MOVQ 24(SI), AX
+	SBBQ AX, 24(DI)
+	RET
@@ -0,0 +1,16 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+//go:build !amd64 || purego
+
+package tnt2engine
+
+// addBlock256 adds key to blk as 256 bit little-endian numbers.
+func addBlock256(blk, key *[CipherBlockBytes]byte) {
+	addBlockGeneric(blk, key)
+}
+
+// subBlock256 subtracts key from blk as 256 bit little-endian numbers.
+func subBlock256(blk, key *[CipherBlockBytes]byte) {
+	subBlockGeneric(blk, key)
+}
@@ -0,0 +1,160 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// origAddBlock is the original byte at a time implementation of AddBlock.
+func origAddBlock(blk, key CipherBlock) CipherBlock {
+	var p int
+	for idx, val := range blk {
+		p += int(val) + int(key[idx])
+		blk[idx] = byte(p & 0xFF)
+		p >>= BitsPerByte
+	}
+	return blk
+}
+
+// origSubBlock is the original byte at a time implementation of SubBlock.
+func origSubBlock(blk, key CipherBlock) CipherBlock {
+	var p int
+	for idx, val := range blk {
+		p = p + int(val) - int(key[idx])
+		blk[idx] = byte(p & 0xFF)
+		p >>= BitsPerByte
+	}
+	return blk
+}
+
+func TestAddSubBlock_matchesOriginal(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	// Include blocks that force a carry/borrow through every byte.
+	ones := make(CipherBlock, CipherBlockBytes)
+	for i := range ones {
+		ones[i] = 0xff
+	}
+	tests := []struct {
+		name string
+		blk  CipherBlock
+		key  CipherBlock
+	}{
+		{
+			name: "tasb1",
+			blk:  ones,
+			key:  append(CipherBlock{1}, make(CipherBlock, CipherBlockBytes-1)...),
+		},
+		{
+			name: "tasb2",
+			blk:  make(CipherBlock, CipherBlockBytes),
+			key:  append(CipherBlock{1}, make(CipherBlock, CipherBlockBytes-1)...),
+		},
+	}
+	for i := 0; i < 1000; i++ {
+		blk := make(CipherBlock, CipherBlockBytes)
+		key := make(CipherBlock, CipherBlockBytes)
+		rnd.Read(blk)
+		rnd.Read(key)
+		tests = append(tests, struct {
+			name string
+			blk  CipherBlock
+			key  CipherBlock
+		}{"tasbr", blk, key})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Check every length from a full block down to an empty (short) block.
+			for n := CipherBlockBytes; n >= 0; n-- {
+				blk, key := tt.blk[:n], tt.key[:n]
+				want := origAddBlock(append(CipherBlock(nil), blk...), key)
+				if got := AddBlock(append(CipherBlock(nil), blk...), key); !reflect.DeepEqual(got, want) {
+					t.Fatalf("AddBlock(len %d) = %v, want %v", n, got, want)
+				}
+				want = origSubBlock(append(CipherBlock(nil), blk...), key)
+				if got := SubBlock(append(CipherBlock(nil), blk...), key); !reflect.DeepEqual(got, want) {
+					t.Fatalf("SubBlock(len %d) = %v, want %v", n, got, want)
+				}
+			}
+			// Check the pure Go implementations used when assembly is not available.
+			want := origAddBlock(append(CipherBlock(nil), tt.blk...), tt.key)
+			got := append(CipherBlock(nil), tt.blk...)
+			addBlockGeneric((*[CipherBlockBytes]byte)(got), (*[CipherBlockBytes]byte)(tt.key))
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("addBlockGeneric() = %v, want %v", got, want)
+			}
+			want = origSubBlock(append(CipherBlock(nil), tt.blk...), tt.key)
+			got = append(CipherBlock(nil), tt.blk...)
+			subBlockGeneric((*[CipherBlockBytes]byte)(got), (*[CipherBlockBytes]byte)(tt.key))
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("subBlockGeneric() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAddSubBlock_long(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	for _, n := range []int{CipherBlockBytes + 1, 2 * CipherBlockBytes} {
+		blk := make(CipherBlock, n)
+		key := make(CipherBlock, n)
+		rnd.Read(blk)
+		rnd.Read(key)
+		// Force a carry (and a borrow) across the first 32 bytes.
+		for i := 0; i < CipherBlockBytes; i++ {
+			blk[i], key[i] = 0xff, 0
+		}
+		key[0] = 1
+		want := origAddBlock(append(CipherBlock(nil), blk...), key)
+		if got := AddBlock(append(CipherBlock(nil), blk...), key); !reflect.DeepEqual(got, want) {
+			t.Errorf("AddBlock(len %d) = %v, want %v", n, got, want)
+		}
+		want = origSubBlock(append(CipherBlock(nil), want...), key)
+		if got := SubBlock(origAddBlock(append(CipherBlock(nil), blk...), key), key); !reflect.DeepEqual(got, want) {
+			t.Errorf("SubBlock(len %d) = %v, want %v", n, got, want)
+		}
+	}
+}
+
+func BenchmarkOrigAddBlock(b *testing.B) {
+	blk := make(CipherBlock, CipherBlockBytes)
+	key := make(CipherBlock, CipherBlockBytes)
+	rand.New(rand.NewSource(1)).Read(key)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		origAddBlock(blk, key)
+	}
+}
+
+func BenchmarkAddBlockGeneric(b *testing.B) {
+	blk := make(CipherBlock, CipherBlockBytes)
+	key := make(CipherBlock, CipherBlockBytes)
+	rand.New(rand.NewSource(1)).Read(key)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		addBlockGeneric((*[CipherBlockBytes]byte)(blk), (*[CipherBlockBytes]byte)(key))
+	}
+}
+
+func BenchmarkAddBlock(b *testing.B) {
+	blk := make(CipherBlock, CipherBlockBytes)
+	key := make(CipherBlock, CipherBlockBytes)
+	rand.New(rand.NewSource(1)).Read(key)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		AddBlock(blk, key)
+	}
+}
+
+func BenchmarkAddBlockShort(b *testing.B) {
+	blk := make(CipherBlock, CipherBlockBytes-5)
+	key := make(CipherBlock, CipherBlockBytes-5)
+	rand.New(rand.NewSource(1)).Read(key)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		AddBlock(blk, key)
+	}
+}
@@ -0,0 +1,287 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the ASCII armor used to paste ciphertext into email and other text,
+// which is similar to the OpenPGP armor (RFC 4880, section 6).
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Armored data looks like:
+//
+//	-----BEGIN TNT2 MESSAGE-----
+//	Index: 1234
+//	Layout: rrprrprr
+//	Version: 1
+//
+//	<the data encoded in base64, 64 columns to a line>
+//	=<the CRC-24 of the data encoded in base64>
+//	-----END TNT2 MESSAGE-----
+//
+// The headers are optional.  The blank line after them is not.
+const (
+	// ArmorMessage is the block type used for encrypted messages.
+	ArmorMessage = "TNT2 MESSAGE"
+	armorColumns = 64
+	armorDashes  = "-----"
+	crc24Init    = 0xb704ce
+	crc24Poly    = 0x1864cfb
+)
+
+// Errors returned when decoding armor.
+var (
+	ErrArmor         = errors.New("tnt2engine: invalid armor")
+	ErrArmorChecksum = errors.New("tnt2engine: armor checksum does not match")
+)
+
+// errArmorClosed is returned by a write to a closed armored block.
+var errArmorClosed = errors.New("tnt2engine: write to a closed armored block")
+
+// crc24 returns the CRC-24 (as used by OpenPGP) of data, continuing from crc.
+func crc24(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= crc24Poly
+			}
+		}
+	}
+	return crc
+}
+
+// encodeCRC24 returns the armor checksum line for crc, without the newline.
+func encodeCRC24(crc uint32) string {
+	return "=" + base64.StdEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)})
+}
+
+// ArmorHeaders returns the armor headers describing a message encrypted by e,
+// starting at its current index, in the stream format.
+func ArmorHeaders(e *Tnt2Engine) map[string]string {
+	return map[string]string{
+		"Index":   e.Index().String(),
+		"Layout":  EngineLayout,
+		"Version": strconv.Itoa(int(StreamVersion)),
+	}
+}
+
+// lineBreaker inserts a newline after every armorColumns bytes written to it.
+type lineBreaker struct {
+	w    io.Writer
+	used int // The number of bytes on the current line.
+}
+
+func (l *lineBreaker) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		cnt := armorColumns - l.used
+		if cnt > len(p) {
+			cnt = len(p)
+		}
+		if _, err = l.w.Write(p[:cnt]); err != nil {
+			return n, err
+		}
+		n += cnt
+		l.used += cnt
+		p = p[cnt:]
+		if l.used == armorColumns {
+			if _, err = io.WriteString(l.w, "\n"); err != nil {
+				return n, err
+			}
+			l.used = 0
+		}
+	}
+	return n, nil
+}
+
+// armorWriter encodes the data written to it as armor.
+type armorWriter struct {
+	w         io.Writer
+	blockType string
+	lines     *lineBreaker
+	b64       io.WriteCloser
+	crc       uint32
+	closed    bool
+}
+
+// NewArmorWriter writes the start of an armored block of the given type, with
+// the given headers (in sorted order), to w.  It returns an io.WriteCloser
+// that encodes the data written to it.  Close must be called to write the end
+// of the block; it does not close w.
+func NewArmorWriter(w io.Writer, blockType string, headers map[string]string) (io.WriteCloser, error) {
+	var buf bytes.Buffer
+	buf.WriteString(armorDashes + "BEGIN " + blockType + armorDashes + "\n")
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		if k == "" || strings.ContainsAny(k, ":\r\n") || strings.ContainsAny(headers[k], "\r\n") {
+			return nil, ErrArmor
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		buf.WriteString(k + ": " + headers[k] + "\n")
+	}
+	buf.WriteString("\n")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	a := &armorWriter{w: w, blockType: blockType, crc: crc24Init}
+	a.lines = &lineBreaker{w: w}
+	a.b64 = base64.NewEncoder(base64.StdEncoding, a.lines)
+	return a, nil
+}
+
+func (a *armorWriter) Write(p []byte) (n int, err error) {
+	if a.closed {
+		return 0, errArmorClosed
+	}
+	a.crc = crc24(a.crc, p)
+	return a.b64.Write(p)
+}
+
+// Close writes the checksum and the end of the armored block.
+func (a *armorWriter) Close() error {
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	if err := a.b64.Close(); err != nil {
+		return err
+	}
+	var end string
+	if a.lines.used > 0 {
+		end = "\n"
+	}
+	end += encodeCRC24(a.crc) + "\n" + armorDashes + "END " + a.blockType + armorDashes + "\n"
+	_, err := io.WriteString(a.w, end)
+	return err
+}
+
+// ArmorBlock is an armored block being decoded.
+type ArmorBlock struct {
+	Type   string            // The type of the block, e.g. ArmorMessage.
+	Header map[string]string // The headers of the block.
+	Body   io.Reader         // Returns the decoded data of the block.
+}
+
+// DecodeArmor reads the start of an armored block from r, skipping any text
+// before it, and returns the block.  Reading Body returns ErrArmorChecksum (or
+// ErrArmor) instead of io.EOF if the data does not match its checksum or the
+// block does not end with a checksum and the END line.
+func DecodeArmor(r io.Reader) (*ArmorBlock, error) {
+	br := bufio.NewReader(r)
+	var blockType string
+	for {
+		line, err := readArmorLine(br)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrArmor
+			}
+			return nil, err
+		}
+		if strings.HasPrefix(line, armorDashes+"BEGIN ") && strings.HasSuffix(line, armorDashes) {
+			blockType = line[len(armorDashes+"BEGIN ") : len(line)-len(armorDashes)]
+			break
+		}
+	}
+	header := make(map[string]string)
+	for {
+		line, err := readArmorLine(br)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrArmor
+			}
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, ErrArmor
+		}
+		header[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	body := &armorBody{r: br, blockType: blockType, crc: crc24Init}
+	return &ArmorBlock{Type: blockType, Header: header, Body: body}, nil
+}
+
+// readArmorLine returns the next line of r without the line ending or any
+// trailing white space.
+func readArmorLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, " \t\r\n"), err
+}
+
+// armorBody decodes the data of an armored block.
+type armorBody struct {
+	r         *bufio.Reader
+	blockType string
+	pending   []byte // Base64 characters not yet decoded.
+	data      []byte // Decoded data not yet read.
+	crc       uint32
+	err       error // The error to return once data is empty.
+}
+
+func (a *armorBody) Read(p []byte) (n int, err error) {
+	for len(a.data) == 0 && a.err == nil {
+		a.err = a.decodeLine()
+	}
+	if len(a.data) == 0 {
+		return 0, a.err
+	}
+	n = copy(p, a.data)
+	a.data = a.data[n:]
+	return n, nil
+}
+
+// decodeLine decodes the next line of the block.  It returns io.EOF after
+// the checksum and the end of the block have been checked.
+func (a *armorBody) decodeLine() error {
+	line, err := readArmorLine(a.r)
+	if err == io.EOF {
+		return ErrArmor
+	} else if err != nil {
+		return err
+	}
+	if strings.HasPrefix(line, "=") || strings.HasPrefix(line, armorDashes) {
+		if len(a.pending) != 0 || !strings.HasPrefix(line, "=") {
+			return ErrArmor
+		}
+		if line != encodeCRC24(a.crc) {
+			return ErrArmorChecksum
+		}
+		if line, err = readArmorLine(a.r); err != nil && err != io.EOF {
+			return err
+		}
+		if line != armorDashes+"END "+a.blockType+armorDashes {
+			return ErrArmor
+		}
+		return io.EOF
+	}
+	a.pending = append(a.pending, line...)
+	cnt := len(a.pending) / 4 * 4
+	a.data = make([]byte, base64.StdEncoding.DecodedLen(cnt))
+	n, err := base64.StdEncoding.Decode(a.data, a.pending[:cnt])
+	if err != nil {
+		return ErrArmor
+	}
+	a.data = a.data[:n]
+	a.pending = append(a.pending[:0], a.pending[cnt:]...)
+	a.crc = crc24(a.crc, a.data)
+	return nil
+}
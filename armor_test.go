@@ -0,0 +1,135 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"bytes"
+	"io"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// armor returns data armored with the given headers.
+func armor(t *testing.T, data []byte, headers map[string]string) string {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := NewArmorWriter(&out, ArmorMessage, headers)
+	if err != nil {
+		t.Fatalf("NewArmorWriter() error = %v", err)
+	}
+	for p := data; len(p) > 0; {
+		n := 1 + len(p)/3
+		if _, err = w.Write(p[:n]); err != nil {
+			t.Fatalf("armorWriter.Write() error = %v", err)
+		}
+		p = p[n:]
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("armorWriter.Close() error = %v", err)
+	}
+	return out.String()
+}
+
+// dearmor decodes the armored block in text.
+func dearmor(text string) (*ArmorBlock, []byte, error) {
+	block, err := DecodeArmor(strings.NewReader(text))
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := io.ReadAll(block.Body)
+	return block, data, err
+}
+
+func TestArmor_RoundTrip(t *testing.T) {
+	data := make([]byte, 500)
+	rand.New(rand.NewSource(1)).Read(data)
+	headers := map[string]string{"Index": "1234", "Version": "1"}
+	for _, size := range []int{0, 1, 2, 3, 47, 48, 49, 96, 500} {
+		text := armor(t, data[:size], headers)
+		lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+		if lines[0] != "-----BEGIN TNT2 MESSAGE-----" || lines[len(lines)-1] != "-----END TNT2 MESSAGE-----" {
+			t.Errorf("%d: the armor is not between BEGIN and END lines:\n%s", size, text)
+		}
+		for _, line := range lines {
+			if len(line) > armorColumns {
+				t.Errorf("%d: the armor has a line of %d columns", size, len(line))
+			}
+		}
+		block, got, err := dearmor(text)
+		if err != nil {
+			t.Fatalf("%d: dearmor() error = %v", size, err)
+		}
+		if block.Type != ArmorMessage || !reflect.DeepEqual(block.Header, headers) {
+			t.Errorf("%d: dearmor() = %q %v, want %q %v", size, block.Type, block.Header, ArmorMessage, headers)
+		}
+		if !bytes.Equal(got, data[:size]) {
+			t.Errorf("%d: dearmor() did not return the data", size)
+		}
+		// Text around the block and CRLF line endings are allowed.
+		crlf := "Hello,\r\n\r\n" + strings.ReplaceAll(text, "\n", "\r\n") + "Bye\r\n"
+		if _, got, err = dearmor(crlf); err != nil || !bytes.Equal(got, data[:size]) {
+			t.Errorf("%d: dearmor() with CRLF did not return the data: %v", size, err)
+		}
+	}
+	if got := armor(t, nil, nil); got != "-----BEGIN TNT2 MESSAGE-----\n\n=twTO\n-----END TNT2 MESSAGE-----\n" {
+		t.Errorf("armor(nil) = %q", got)
+	}
+	if _, err := NewArmorWriter(io.Discard, ArmorMessage, map[string]string{"A:B": "c"}); err != ErrArmor {
+		t.Errorf("NewArmorWriter() with a bad header error = %v, want %v", err, ErrArmor)
+	}
+	w, _ := NewArmorWriter(io.Discard, ArmorMessage, nil)
+	w.Close()
+	if _, err := w.Write([]byte("x")); err != errArmorClosed {
+		t.Errorf("armorWriter.Write() after Close error = %v, want %v", err, errArmorClosed)
+	}
+}
+
+func TestDecodeArmor_Errors(t *testing.T) {
+	text := armor(t, []byte("The quick brown fox jumps over the lazy dog"), map[string]string{"Index": "7"})
+	lines := strings.SplitAfter(strings.TrimSuffix(text, "\n"), "\n")
+	crcLine := len(lines) - 2
+	tests := []struct {
+		name    string
+		text    string
+		wantErr error
+	}{
+		{name: "tdae1", text: strings.Replace(text, "VGhl", "VGhm", 1), wantErr: ErrArmorChecksum},
+		{name: "tdae2", text: strings.Join(lines[:len(lines)-1], ""), wantErr: ErrArmor},
+		{name: "tdae3", text: strings.Join(append(lines[:crcLine:crcLine], lines[crcLine+1:]...), ""), wantErr: ErrArmor},
+		{name: "tdae4", text: strings.Replace(text, "END TNT2", "END TNT3", 1), wantErr: ErrArmor},
+		{name: "tdae5", text: strings.Replace(text, "VGhl", "V!hl", 1), wantErr: ErrArmor},
+		{name: "tdae6", text: strings.Replace(text, "Index: 7", "Index 7", 1), wantErr: ErrArmor},
+		{name: "tdae7", text: "no armor here\n", wantErr: ErrArmor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := dearmor(tt.text); err != tt.wantErr {
+				t.Errorf("dearmor() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestArmor_Stream(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	tnt2Machine.SetIndex(big.NewInt(2024))
+	plaintext := []byte("Meet me at the usual place at ten.")
+	headers := ArmorHeaders(&tnt2Machine)
+	text := armor(t, encryptStream(t, &tnt2Machine, plaintext, DefaultChunkSize, 10), headers)
+	block, stream, err := dearmor(text)
+	if err != nil {
+		t.Fatalf("dearmor() error = %v", err)
+	}
+	want := map[string]string{"Index": "2024", "Layout": EngineLayout, "Version": "1"}
+	if !reflect.DeepEqual(block.Header, want) {
+		t.Errorf("ArmorHeaders() = %v, want %v", block.Header, want)
+	}
+	if got, err := decryptStream(&tnt2Machine, stream); err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("decryptStream() of the armored stream = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,202 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the batched cipher machine used by tnt2engine.
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// DefaultPipelineDepth is the default number of batches that can be buffered
+// between each stage of the batched cipher machine.
+const DefaultPipelineDepth int = 4
+
+// CipherBatch is a group of CipherBlocks that is passed between the stages of
+// the batched cipher machine in a single channel message.  This spreads the
+// cost of the channel operations over all of the blocks in the batch.  Each
+// crypter processes the blocks in order, stepping its state once for each
+// block, so the result is the same as sending the blocks one at a time.
+type CipherBatch []CipherBlock
+
+// applyBatch applies the encryption (or decryption) function of ecm to each of
+// the blocks in the batch, in place where possible.
+func applyBatch(ecm Crypter, batch CipherBatch, decrypt bool) {
+	bcm, isBlockCrypter := ecm.(BlockCrypter)
+	for idx, blk := range batch {
+		switch {
+		case isBlockCrypter && decrypt:
+			bcm.ApplyGTo(blk, blk)
+		case isBlockCrypter:
+			bcm.ApplyFTo(blk, blk)
+		case decrypt:
+			batch[idx] = ecm.ApplyG(blk)
+		default:
+			batch[idx] = ecm.ApplyF(blk)
+		}
+	}
+}
+
+// batchMachine sets up a rotor, permutator, or counter to encrypt (or decrypt)
+// the batches read from the left channel and send them out on the right
+// channel.  The right channel can buffer depth batches.  The machine exits
+// after passing on a batch with a length of zero, when the left channel is
+// closed, or when ctx is cancelled.  If wg is not nil, it is marked done when
+// the machine exits.
+func batchMachine(ctx context.Context, ecm Crypter, left chan CipherBatch, wg *sync.WaitGroup, depth int, decrypt bool) chan CipherBatch {
+	if ecm == nil {
+		panic("ecm is nil")
+	}
+	right := make(chan CipherBatch, depth)
+	if wg != nil {
+		wg.Add(1)
+	}
+	go func(ecm Crypter, left chan CipherBatch, right chan CipherBatch) {
+		if wg != nil {
+			defer wg.Done()
+		}
+		defer close(right)
+		for {
+			var inp CipherBatch
+			select {
+			case inp = <-left:
+			case <-ctx.Done():
+				return
+			}
+			applyBatch(ecm, inp, decrypt)
+			select {
+			case right <- inp:
+			case <-ctx.Done():
+				return
+			}
+			if len(inp) <= 0 {
+				return
+			}
+		}
+	}(ecm, left, right)
+	return right
+}
+
+// EncryptBatchMachine - set up a rotor, permutator, or counter to encrypt the
+// batches read from the left (input channel) and send them out on the right
+// (output channel).  The right channel can buffer depth batches.
+func EncryptBatchMachine(ecm Crypter, left chan CipherBatch, depth int) chan CipherBatch {
+	return batchMachine(context.Background(), ecm, left, nil, depth, false)
+}
+
+// DecryptBatchMachine - set up a rotor, permutator, or counter to decrypt the
+// batches read from the left (input channel) and send them out on the right
+// (output channel).  The right channel can buffer depth batches.
+func DecryptBatchMachine(ecm Crypter, left chan CipherBatch, depth int) chan CipherBatch {
+	return batchMachine(context.Background(), ecm, left, nil, depth, true)
+}
+
+// createBatchMachine - Chain the batched encryption (or decryption) machines
+// together, using buffered channels to pass the batches to the individual
+// machines.  The decryption machines are chained in reverse order.  Every
+// machine exits when ctx is cancelled and is added to wg (if it is not nil).
+func createBatchMachine(ctx context.Context, wg *sync.WaitGroup, depth int, decrypt bool, ecms ...Crypter) (left chan CipherBatch, right chan CipherBatch) {
+	if len(ecms) == 0 {
+		if decrypt {
+			panic("you must give at least one decryption device!")
+		}
+		panic("you must give at least one encryption device!")
+	}
+	left = make(chan CipherBatch, depth)
+	right = left
+	if decrypt {
+		for idx := len(ecms) - 1; idx >= 0; idx-- {
+			right = batchMachine(ctx, ecms[idx], right, wg, depth, true)
+		}
+	} else {
+		for _, ecm := range ecms {
+			right = batchMachine(ctx, ecm, right, wg, depth, false)
+		}
+	}
+	return
+}
+
+// createEncryptBatchMachine - Chain the batched encryption machines together,
+// using buffered channels to pass the batches to be encrypted to the
+// individual encryption machines.
+func createEncryptBatchMachine(depth int, ecms ...Crypter) (left chan CipherBatch, right chan CipherBatch) {
+	return createBatchMachine(context.Background(), nil, depth, false, ecms...)
+}
+
+// createDecryptBatchMachine - Chain the batched decryption machines together
+// (in reverse order), using buffered channels to pass the batches to be
+// decrypted to the individual decryption machines.
+func createDecryptBatchMachine(depth int, ecms ...Crypter) (left chan CipherBatch, right chan CipherBatch) {
+	return createBatchMachine(context.Background(), nil, depth, true, ecms...)
+}
+
+// SetPipelineDepth is a setter function that sets the number of batches that
+// can be buffered between the stages of the batched cipher machine.  A depth
+// greater than zero lets the stages work on different batches at the same
+// time.  Init sets the depth to DefaultPipelineDepth.  It takes effect the
+// next time BuildBatchCipherMachine is called.
+func (e *Tnt2Engine) SetPipelineDepth(depth int) {
+	if depth < 0 {
+		depth = 0
+	}
+	e.pipelineDepth = depth
+}
+
+// PipelineDepth is a getter function that returns the number of batches that
+// can be buffered between the stages of the batched cipher machine.
+func (e *Tnt2Engine) PipelineDepth() int {
+	return e.pipelineDepth
+}
+
+// BatchLeft is a getter that returns the input channel for the batched cipher
+// machine.
+func (e *Tnt2Engine) BatchLeft() chan CipherBatch {
+	return e.batchLeft
+}
+
+// BatchRight is a getter that returns the output channel for the batched
+// cipher machine.
+func (e *Tnt2Engine) BatchRight() chan CipherBatch {
+	return e.batchRight
+}
+
+// BuildBatchCipherMachine will create a "machine" to encrypt or decrypt the
+// batches of blocks sent to the BatchLeft channel and output on the BatchRight
+// channel.  The engineType determines whether an encrypt machine or a decrypt
+// machine will be created.  It returns an error if the engine is not Ready.
+func (e *Tnt2Engine) BuildBatchCipherMachine() error {
+	return e.BuildBatchCipherMachineContext(context.Background())
+}
+
+// BuildBatchCipherMachineContext is like BuildBatchCipherMachine, but the
+// stages of the machine exit when ctx is cancelled.  The BatchRight channel is
+// then closed and the engine returns to the Ready state.
+func (e *Tnt2Engine) BuildBatchCipherMachineContext(ctx context.Context) error {
+	if err := e.checkStart(); err != nil {
+		return err
+	}
+	switch e.engineType {
+	case "D":
+		e.startMachine(ctx, true, true)
+	case "E":
+		e.startMachine(ctx, true, false)
+	default:
+		log.Fatalf("Missing or incorrect Tnt2Engine engineType: [%s]", e.engineType)
+	}
+	return nil
+}
+
+// CloseBatchCipherMachine will close down the batched cipher machine by
+// passing it a CipherBatch with a length of zero (0) and waiting for it to
+// come out of the other end.  Any batches still in the machine are discarded.
+// It returns ErrNotRunning if the batched cipher machine is not running.
+func (e *Tnt2Engine) CloseBatchCipherMachine() error {
+	if e.State() != Running || !e.batchRunning {
+		return ErrNotRunning
+	}
+	e.stopMachine()
+	return nil
+}
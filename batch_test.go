@@ -0,0 +1,139 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// makeBlocks splits data into CipherBlocks (the last of which may be short).
+func makeBlocks(data []byte) []CipherBlock {
+	var blks []CipherBlock
+	for len(data) > 0 {
+		n := len(data)
+		if n > CipherBlockBytes {
+			n = CipherBlockBytes
+		}
+		blks = append(blks, append(CipherBlock(nil), data[:n]...))
+		data = data[n:]
+	}
+	return blks
+}
+
+func TestTnt2Engine_BuildBatchCipherMachine(t *testing.T) {
+	data := make([]byte, 100*CipherBlockBytes+7)
+	rand.New(rand.NewSource(1)).Read(data)
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	// Encrypt the data one block at a time to get the expected results.
+	tnt2Machine.SetEngineType("E")
+	tnt2Machine.SetIndex(BigZero)
+	tnt2Machine.BuildCipherMachine()
+	var want []CipherBlock
+	for _, blk := range makeBlocks(data) {
+		tnt2Machine.Left() <- blk
+		want = append(want, <-tnt2Machine.Right())
+	}
+	tnt2Machine.CloseCipherMachine()
+	tests := []struct {
+		name      string
+		batchSize int
+		depth     int
+	}{
+		{
+			name:      "ttebbcm1",
+			batchSize: 1,
+			depth:     0,
+		},
+		{
+			name:      "ttebbcm2",
+			batchSize: 7,
+			depth:     DefaultPipelineDepth,
+		},
+		{
+			name:      "ttebbcm3",
+			batchSize: 1024,
+			depth:     1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tnt2Machine.SetPipelineDepth(tt.depth)
+			tnt2Machine.SetEngineType("E")
+			tnt2Machine.SetIndex(BigZero)
+			tnt2Machine.BuildBatchCipherMachine()
+			if got := cap(tnt2Machine.BatchLeft()); got != tt.depth {
+				t.Errorf("cap(Tnt2Engine.BatchLeft()) = %d, want %d", got, tt.depth)
+			}
+			blks := makeBlocks(data)
+			var got []CipherBlock
+			for len(blks) > 0 {
+				n := len(blks)
+				if n > tt.batchSize {
+					n = tt.batchSize
+				}
+				tnt2Machine.BatchLeft() <- CipherBatch(blks[:n])
+				got = append(got, <-tnt2Machine.BatchRight()...)
+				blks = blks[n:]
+			}
+			tnt2Machine.CloseBatchCipherMachine()
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("batched encryption does not match the unbatched encryption")
+			}
+			if cnt := tnt2Machine.Index(); cnt.Cmp(big.NewInt(int64(len(want)))) != 0 {
+				t.Errorf("Tnt2Engine.Index() = %s, want %d", cnt, len(want))
+			}
+			// Decrypt the batches and check against the original data.
+			tnt2Machine.SetEngineType("D")
+			tnt2Machine.SetIndex(BigZero)
+			tnt2Machine.BuildBatchCipherMachine()
+			tnt2Machine.BatchLeft() <- CipherBatch(got)
+			var plain []byte
+			for _, blk := range <-tnt2Machine.BatchRight() {
+				plain = append(plain, blk...)
+			}
+			tnt2Machine.CloseBatchCipherMachine()
+			if !reflect.DeepEqual(plain, data) {
+				t.Errorf("batched decryption does not match the original data")
+			}
+		})
+	}
+}
+
+func BenchmarkBatchCipherMachine(b *testing.B) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	tnt2Machine.SetEngineType("E")
+	for _, batchSize := range []int{1, 64, 1024} {
+		b.Run(fmt.Sprintf("%d-blocks", batchSize), func(b *testing.B) {
+			tnt2Machine.SetIndex(BigZero)
+			tnt2Machine.BuildBatchCipherMachine()
+			defer tnt2Machine.CloseBatchCipherMachine()
+			// Use enough batches to keep every stage of the machine busy.
+			batches := make([]CipherBatch, (len(tnt2Machine.engine)+1)*(tnt2Machine.PipelineDepth()+1))
+			for i := range batches {
+				batches[i] = make(CipherBatch, batchSize)
+				for j := range batches[i] {
+					batches[i][j] = make(CipherBlock, CipherBlockBytes)
+				}
+			}
+			nBatches := (b.N + batchSize - 1) / batchSize
+			b.SetBytes(int64(CipherBlockBytes))
+			b.ReportAllocs()
+			b.ResetTimer()
+			go func() {
+				for i := 0; i < nBatches; i++ {
+					tnt2Machine.BatchLeft() <- batches[i%len(batches)]
+				}
+			}()
+			for i := 0; i < nBatches; i++ {
+				<-tnt2Machine.BatchRight()
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the Cascade type, which chains independently keyed engines together.
+
+import (
+	"context"
+	"errors"
+	"math/big"
+)
+
+// Engine is the interface to the per-block cipher machine that is shared by
+// Tnt2Engine and Cascade.  Blocks sent to Left are encrypted (or decrypted)
+// and returned, in order, on Right once the cipher machine is built.
+type Engine interface {
+	Left() chan CipherBlock
+	Right() chan CipherBlock
+	Index() *big.Int
+	SetIndex(*big.Int)
+	SetEngineType(string)
+	EngineType() string
+	BuildCipherMachine() error
+	CloseCipherMachine() error
+	Close() error
+}
+
+var errCascade = errors.New("tnt2engine: a cascade needs at least two initialized engines with different keys")
+
+// Cascade encrypts each block with two or more engines, which have independent
+// secret keys and may have different layouts.  When encrypting, the output of
+// each engine is the input of the next one; when decrypting, the engines are
+// applied in the reverse order.  An attacker must then break every engine to
+// recover the plaintext.
+//
+// Each engine keeps its own counter, so Index returns the block number of the
+// last engine, and the engines can be positioned separately (using the
+// engines themselves) before the cipher machine is built.
+//
+// A Cascade can only be used where an Engine is accepted.  The stream writer
+// and reader, DecryptReaderAt, and Envelope take a *Tnt2Engine, as they need a
+// key check value, derived keys, or Clone, which a cascade does not have.
+type Cascade struct {
+	engines []*Tnt2Engine
+	// chain is an engine holding the rotors, permutators, and counters of
+	// all of the engines, in order.
+	chain Tnt2Engine
+}
+
+// NewCascade returns a Cascade of the engines, which must be initialized, have
+// different secret keys (as shown by their CounterKey), and not have a cipher
+// machine running.  The rotors, permutators, and counters of
+// the engines are shared with the cascade, so the engines must not be used on
+// their own while the cipher machine of the cascade is running.
+func NewCascade(engines ...*Tnt2Engine) (*Cascade, error) {
+	if len(engines) < 2 {
+		return nil, errCascade
+	}
+	c := new(Cascade)
+	seen := make(map[string]bool)
+	for _, e := range engines {
+		if e.State() != Ready || seen[e.CounterKey()] {
+			return nil, errCascade
+		}
+		seen[e.CounterKey()] = true
+		c.chain.engine = append(c.chain.engine, e.engine...)
+	}
+	c.engines = append([]*Tnt2Engine(nil), engines...)
+	c.chain.pipelineDepth = DefaultPipelineDepth
+	c.chain.state = Ready
+	return c, nil
+}
+
+// Engines returns the engines of the cascade, in the order they encrypt.
+func (c *Cascade) Engines() []*Tnt2Engine {
+	return append([]*Tnt2Engine(nil), c.engines...)
+}
+
+// Left is a getter that returns the input channel of the cascade.
+func (c *Cascade) Left() chan CipherBlock {
+	return c.chain.Left()
+}
+
+// Right is a getter that returns the output channel of the cascade.
+func (c *Cascade) Right() chan CipherBlock {
+	return c.chain.Right()
+}
+
+// Index returns the block number of the next block to be encrypted by the
+// last engine of the cascade.
+func (c *Cascade) Index() *big.Int {
+	return c.chain.Index()
+}
+
+// SetIndex positions every engine of the cascade at the block number iCnt.
+func (c *Cascade) SetIndex(iCnt *big.Int) {
+	c.chain.SetIndex(iCnt)
+}
+
+// SetEngineType sets whether the cascade encrypts ("E") or decrypts ("D").
+func (c *Cascade) SetEngineType(engineType string) {
+	c.chain.SetEngineType(engineType)
+}
+
+// EngineType returns whether the cascade encrypts ("E") or decrypts ("D").
+func (c *Cascade) EngineType() string {
+	return c.chain.EngineType()
+}
+
+// State returns the state of the cascade.
+func (c *Cascade) State() EngineState {
+	return c.chain.State()
+}
+
+// Done returns a channel that is closed when the cipher machine of the cascade
+// has stopped.
+func (c *Cascade) Done() <-chan struct{} {
+	return c.chain.Done()
+}
+
+// BuildCipherMachine builds the cipher machine of the cascade, a single
+// pipeline through the rotors and permutators of all of the engines.
+func (c *Cascade) BuildCipherMachine() error {
+	return c.chain.BuildCipherMachine()
+}
+
+// BuildCipherMachineContext is like BuildCipherMachine, but the cipher machine
+// stops when ctx is cancelled.
+func (c *Cascade) BuildCipherMachineContext(ctx context.Context) error {
+	return c.chain.BuildCipherMachineContext(ctx)
+}
+
+// CloseCipherMachine shuts down the cipher machine of the cascade.
+func (c *Cascade) CloseCipherMachine() error {
+	return c.chain.CloseCipherMachine()
+}
+
+// Close shuts down any running cipher machine and closes the cascade.  The
+// engines themselves are not closed.
+func (c *Cascade) Close() error {
+	return c.chain.Close()
+}
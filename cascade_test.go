@@ -0,0 +1,110 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"bytes"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+// Both engine types provide the per-block cipher machine.
+var (
+	_ Engine = (*Tnt2Engine)(nil)
+	_ Engine = (*Cascade)(nil)
+)
+
+func TestCascade(t *testing.T) {
+	var first, second Tnt2Engine
+	first.Init([]byte("FirstKey"), "")
+	EngineLayout = "rpr"
+	second.Init([]byte("SecondKey"), "")
+	EngineLayout = "rrprrprr"
+	c, err := NewCascade(&first, &second)
+	if err != nil {
+		t.Fatalf("NewCascade() error = %v", err)
+	}
+	plaintext := make([]byte, 7*CipherBlockBytes+11)
+	rand.New(rand.NewSource(1)).Read(plaintext)
+	start := big.NewInt(300)
+	c.SetIndex(start)
+	ciphertext, err := runMachine(c, "E", plaintext)
+	if err != nil {
+		t.Fatalf("runMachine() error = %v", err)
+	}
+	blocks := int64((len(plaintext) + CipherBlockBytes - 1) / CipherBlockBytes)
+	for i, e := range c.Engines() {
+		if got := e.Index(); got.Int64() != 300+blocks {
+			t.Errorf("engine %d: Index() after encrypting = %s, want %d", i, got, 300+blocks)
+		}
+	}
+	if got := c.Index(); got.Int64() != 300+blocks {
+		t.Errorf("Cascade.Index() after encrypting = %s, want %d", got, 300+blocks)
+	}
+	// The ciphertext of the cascade is the plaintext encrypted by the first
+	// engine and then by the second one.
+	want := encryptMessage(t, &second, encryptMessage(t, &first, plaintext, start), start)
+	if !bytes.Equal(ciphertext, want) {
+		t.Errorf("the cascade did not encrypt with each engine in turn")
+	}
+	c.SetIndex(start)
+	if got, err := runMachine(c, "D", ciphertext); err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("runMachine() did not decrypt the ciphertext: %v", err)
+	}
+	// The engines can be at different block numbers.
+	first.SetIndex(big.NewInt(10))
+	second.SetIndex(big.NewInt(20000))
+	ciphertext, err = runMachine(c, "E", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = encryptMessage(t, &second, encryptMessage(t, &first, plaintext, big.NewInt(10)), big.NewInt(20000))
+	if !bytes.Equal(ciphertext, want) {
+		t.Errorf("the cascade did not use the block number of each engine")
+	}
+	if err = c.Close(); err != nil || c.State() != Closed {
+		t.Errorf("Cascade.Close() = %v, state %s", err, c.State())
+	}
+	if err = c.BuildCipherMachine(); err != ErrEngineClosed {
+		t.Errorf("Cascade.BuildCipherMachine() after Close error = %v, want %v", err, ErrEngineClosed)
+	}
+	if first.State() != Ready {
+		t.Errorf("Cascade.Close() changed the state of an engine to %s", first.State())
+	}
+}
+
+func TestNewCascade(t *testing.T) {
+	var first, second, third, sameKey, uninitialized Tnt2Engine
+	first.Init([]byte("FirstKey"), "")
+	second.Init([]byte("SecondKey"), "")
+	third.Init([]byte("ThirdKey"), "")
+	sameKey.Init([]byte("FirstKey"), "")
+	for _, engines := range [][]*Tnt2Engine{nil, {&first}, {&first, &first}, {&first, &uninitialized},
+		{&first, first.Clone()}, {&first, &second, &sameKey}} {
+		if _, err := NewCascade(engines...); err != errCascade {
+			t.Errorf("NewCascade(%d engines) error = %v, want %v", len(engines), err, errCascade)
+		}
+	}
+	c, err := NewCascade(&first, &second, &third)
+	if err != nil {
+		t.Fatalf("NewCascade() error = %v", err)
+	}
+	if got := len(c.Engines()); got != 3 {
+		t.Errorf("len(Cascade.Engines()) = %d, want 3", got)
+	}
+	c.SetEngineType("E")
+	if err = c.BuildCipherMachine(); err != nil {
+		t.Fatalf("Cascade.BuildCipherMachine() error = %v", err)
+	}
+	if c.State() != Running || c.EngineType() != "E" {
+		t.Errorf("Cascade state = %s, type %s, want Running, E", c.State(), c.EngineType())
+	}
+	if err = c.CloseCipherMachine(); err != nil {
+		t.Errorf("Cascade.CloseCipherMachine() error = %v", err)
+	}
+	if c.State() != Ready {
+		t.Errorf("Cascade state after CloseCipherMachine = %s, want Ready", c.State())
+	}
+}
@@ -0,0 +1,317 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the Conn type, which encrypts and authenticates the data sent over a
+// point-to-point network connection.
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// A connection starts with a handshake.  The client sends a hello, and the
+// server replies with its own hello:
+//
+//	magic      [4]byte  "TNTC"
+//	version    byte     ConnVersion
+//	keyCheck   [4]byte  the KeyCheck of the engine the sender encrypts with
+//	start      [16]byte big-endian block number of the first frame it sends
+//
+// Each side encrypts with its own engine, created from the shared secret and
+// the direction, so the two directions never use the same key stream.  After
+// the handshake, the data is sent in frames:
+//
+//	length     uint32   big-endian, the length of the data (at most
+//	                    MaxFrameSize)
+//	data       []byte   the data encrypted starting at the block following
+//	                    the previous frame
+//	tag        [32]byte HMAC-SHA256 over the hash of both hellos, the frame
+//	                    number, the length, and the encrypted data
+//
+// The tag is keyed by a key derived from the engine of the direction.  Since
+// the frame number and the random start of both sides are part of the tag,
+// a frame that is replayed, reordered, or taken from another connection fails
+// authentication.  An empty frame is sent by Close to mark the end of the
+// data, so a connection cut short is detected.
+const (
+	ConnVersion  byte = 1
+	MaxFrameSize int  = 16 * 1024
+	helloSize    int  = 4 + 1 + KeyCheckSize + 16
+	closeTimeout      = 5 * time.Second
+)
+
+var (
+	connMagic       = [4]byte{'T', 'N', 'T', 'C'}
+	clientDirection = "\x00tnt2engine client to server"
+	serverDirection = "\x00tnt2engine server to client"
+)
+
+// Errors returned by a Conn.
+var (
+	ErrHandshake = errors.New("tnt2engine: invalid handshake")
+	ErrFrameAuth = errors.New("tnt2engine: frame failed authentication")
+	errFrameSize = errors.New("tnt2engine: frame is too large")
+)
+
+// connDirection holds the state of one direction of a Conn.
+type connDirection struct {
+	mu    sync.Mutex
+	e     *Tnt2Engine
+	mac   hash.Hash
+	next  *big.Int // The block number of the start of the next frame.
+	frame uint64   // The number of the next frame.
+	err   error    // Set once the direction can no longer be used.
+}
+
+// newConnDirection returns the direction encrypted by an engine created from
+// secret and the name of the direction.
+func newConnDirection(secret []byte, direction string) *connDirection {
+	d := new(connDirection)
+	d.e = new(Tnt2Engine)
+	d.e.Init(append(append([]byte(nil), secret...), direction...), "")
+	d.mac = hmac.New(sha256.New, d.e.deriveKey("conn frame mac"))
+	return d
+}
+
+// tag returns the tag of the current frame.
+func (d *connDirection) tag(transcript, ciphertext []byte) []byte {
+	var buf [12]byte
+	binary.BigEndian.PutUint64(buf[:], d.frame)
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(ciphertext)))
+	d.mac.Reset()
+	d.mac.Write(transcript)
+	d.mac.Write(buf[:])
+	d.mac.Write(ciphertext)
+	return d.mac.Sum(nil)
+}
+
+// Conn is a net.Conn that encrypts and authenticates the data written to it,
+// and decrypts and checks the data read from it.  Read and Write can be called
+// at the same time from different goroutines.
+type Conn struct {
+	net.Conn
+	out, in    *connDirection
+	transcript []byte          // The hash of the two hellos.
+	rbuf       []byte          // Decrypted data that has not been read yet.
+	peerStatic *ecdh.PublicKey // The static key of the peer (see ClientECDH).
+	closeOnce  sync.Once
+	closeErr   error
+}
+
+// Client performs the handshake over conn as the client, using the shared
+// secret, and returns the encrypted connection.  It returns ErrWrongKey if
+// the server uses a different secret.
+//
+// The handshake has no time limit of its own.  To stop it waiting forever for
+// a peer that does not reply, set a deadline on conn before calling Client (or
+// any of the other handshakes), and clear it once the handshake returns.
+func Client(conn net.Conn, secret []byte) (*Conn, error) {
+	return handshake(conn, secret, true)
+}
+
+// Server performs the handshake over conn as the server, using the shared
+// secret, and returns the encrypted connection.  It returns ErrWrongKey if
+// the client uses a different secret.  As with Client, the caller must set a
+// deadline on conn to limit the time the handshake takes.
+func Server(conn net.Conn, secret []byte) (*Conn, error) {
+	return handshake(conn, secret, false)
+}
+
+// newConn returns a Conn over conn with the engines of both directions created
+// from secret.  The block numbers of the first frames and the transcript must
+// be set by the handshake.
+func newConn(conn net.Conn, secret []byte, client bool) *Conn {
+	c := &Conn{Conn: conn}
+	if client {
+		c.out = newConnDirection(secret, clientDirection)
+		c.in = newConnDirection(secret, serverDirection)
+	} else {
+		c.out = newConnDirection(secret, serverDirection)
+		c.in = newConnDirection(secret, clientDirection)
+	}
+	return c
+}
+
+// handshake exchanges hellos over conn and returns the encrypted connection.
+func handshake(conn net.Conn, secret []byte, client bool) (*Conn, error) {
+	c := newConn(conn, secret, client)
+	start := make([]byte, 16)
+	if _, err := rand.Read(start); err != nil {
+		return nil, err
+	}
+	c.out.next = new(big.Int).SetBytes(start)
+	hello := make([]byte, 0, helloSize)
+	hello = append(hello, connMagic[:]...)
+	hello = append(hello, ConnVersion)
+	hello = append(hello, c.out.e.KeyCheck()...)
+	hello = append(hello, start...)
+	if client {
+		if _, err := conn.Write(hello); err != nil {
+			return nil, err
+		}
+	}
+	peer := make([]byte, helloSize)
+	if _, err := io.ReadFull(conn, peer); err != nil {
+		return nil, err
+	}
+	if [4]byte(peer[:4]) != connMagic || peer[4] != ConnVersion {
+		return nil, ErrHandshake
+	}
+	// The server replies even if the key checks differ, so that both sides
+	// report ErrWrongKey.
+	if !client {
+		if _, err := conn.Write(hello); err != nil {
+			return nil, err
+		}
+	}
+	if !bytes.Equal(peer[5:5+KeyCheckSize], c.in.e.KeyCheck()) {
+		return nil, ErrWrongKey
+	}
+	c.in.next = new(big.Int).SetBytes(peer[5+KeyCheckSize:])
+	h := sha256.New()
+	if client {
+		h.Write(hello)
+		h.Write(peer)
+	} else {
+		h.Write(peer)
+		h.Write(hello)
+	}
+	c.transcript = h.Sum(nil)
+	return c, nil
+}
+
+// Write encrypts p and sends it in one or more frames.
+func (c *Conn) Write(p []byte) (n int, err error) {
+	c.out.mu.Lock()
+	defer c.out.mu.Unlock()
+	for len(p) > 0 {
+		cnt := len(p)
+		if cnt > MaxFrameSize {
+			cnt = MaxFrameSize
+		}
+		if err = c.writeFrame(p[:cnt]); err != nil {
+			return n, err
+		}
+		n += cnt
+		p = p[cnt:]
+	}
+	return n, nil
+}
+
+// writeFrame encrypts data and sends it as the next frame.
+func (c *Conn) writeFrame(data []byte) error {
+	d := c.out
+	if d.err != nil {
+		return d.err
+	}
+	d.e.SetIndex(d.next)
+	ciphertext, err := runMachine(d.e, "E", data)
+	if err != nil {
+		d.err = err
+		return err
+	}
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(ciphertext)+sha256.Size), uint32(len(ciphertext)))
+	frame = append(frame, ciphertext...)
+	frame = append(frame, d.tag(c.transcript, ciphertext)...)
+	if _, err = c.Conn.Write(frame); err != nil {
+		d.err = err
+		return err
+	}
+	d.next = d.e.Index()
+	d.frame++
+	return nil
+}
+
+// Read reads decrypted data into p.  It returns io.EOF once the peer has closed
+// the connection, io.ErrUnexpectedEOF if the connection ends without being
+// closed by the peer, and ErrFrameAuth if a frame has been changed, replayed,
+// or reordered.
+func (c *Conn) Read(p []byte) (n int, err error) {
+	c.in.mu.Lock()
+	defer c.in.mu.Unlock()
+	for len(c.rbuf) == 0 {
+		if c.in.err != nil {
+			return 0, c.in.err
+		}
+		c.in.err = c.readFrame()
+	}
+	n = copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// readFrame reads, checks, and decrypts the next frame.
+func (c *Conn) readFrame() error {
+	d := c.in
+	var length [4]byte
+	if _, err := io.ReadFull(c.Conn, length[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > uint32(MaxFrameSize) {
+		return errFrameSize
+	}
+	buf := make([]byte, int(size)+sha256.Size)
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	ciphertext, tag := buf[:size], buf[size:]
+	if !hmac.Equal(tag, d.tag(c.transcript, ciphertext)) {
+		return ErrFrameAuth
+	}
+	d.frame++
+	if size == 0 {
+		return io.EOF
+	}
+	d.e.SetIndex(d.next)
+	plaintext, err := runMachine(d.e, "D", ciphertext)
+	if err != nil {
+		return err
+	}
+	d.next = d.e.Index()
+	c.rbuf = plaintext
+	return nil
+}
+
+// Close sends an empty frame, which tells the peer that all of the data has
+// been sent, and closes the connection.  It returns the first error from
+// sending the frame or closing the connection.  If a Write is in progress
+// (e.g. blocked because the peer is not reading), the frame is not sent, and
+// closing the connection makes the Write fail.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		if c.out.mu.TryLock() {
+			if c.out.err == nil {
+				if err := c.writeFrame(nil); c.closeErr == nil {
+					c.closeErr = err
+				}
+				c.out.err = net.ErrClosed
+			}
+			c.out.mu.Unlock()
+		}
+		if err := c.Conn.Close(); c.closeErr == nil {
+			c.closeErr = err
+		}
+	})
+	return c.closeErr
+}
@@ -0,0 +1,230 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// connPair performs the handshake over the two ends of a connection and
+// returns the encrypted client and server connections.
+func connPair(clientEnd, serverEnd net.Conn, clientSecret, serverSecret string) (client, server *Conn, clientErr, serverErr error) {
+	done := make(chan struct{})
+	go func() {
+		server, serverErr = Server(serverEnd, []byte(serverSecret))
+		close(done)
+	}()
+	client, clientErr = Client(clientEnd, []byte(clientSecret))
+	<-done
+	return client, server, clientErr, serverErr
+}
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	clientEnd, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverEnd := <-accepted
+	if serverEnd == nil {
+		t.Fatal("Accept() failed")
+	}
+	return clientEnd, serverEnd
+}
+
+func TestConn(t *testing.T) {
+	message := make([]byte, 3*MaxFrameSize+1000)
+	rand.New(rand.NewSource(1)).Read(message)
+	reply := []byte("Message received.")
+	pipeClient, pipeServer := net.Pipe()
+	tcpClient, tcpServer := tcpPair(t)
+	tests := []struct {
+		name           string
+		client, server net.Conn
+	}{
+		{name: "tc1", client: pipeClient, server: pipeServer},
+		{name: "tc2", client: tcpClient, server: tcpServer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server, clientErr, serverErr := connPair(tt.client, tt.server, "SharedSecret", "SharedSecret")
+			if clientErr != nil || serverErr != nil {
+				t.Fatalf("handshake errors = %v, %v", clientErr, serverErr)
+			}
+			type result struct {
+				data []byte
+				err  error
+			}
+			received := make(chan result)
+			go func() {
+				if _, err := server.Write(reply); err != nil {
+					received <- result{nil, err}
+					return
+				}
+				data, err := io.ReadAll(server)
+				server.Close()
+				received <- result{data, err}
+			}()
+			got := make([]byte, len(reply))
+			if _, err := io.ReadFull(client, got); err != nil || !bytes.Equal(got, reply) {
+				t.Fatalf("io.ReadFull() = %q, %v, want %q", got, err, reply)
+			}
+			for p, rnd := message, rand.New(rand.NewSource(2)); len(p) > 0; {
+				n := 1 + rnd.Intn(2*MaxFrameSize)
+				if n > len(p) {
+					n = len(p)
+				}
+				if _, err := client.Write(p[:n]); err != nil {
+					t.Fatalf("Conn.Write() error = %v", err)
+				}
+				p = p[n:]
+			}
+			if err := client.Close(); err != nil {
+				t.Errorf("Conn.Close() error = %v", err)
+			}
+			if _, err := client.Write(reply); err == nil {
+				t.Errorf("Conn.Write() after Close did not fail")
+			}
+			res := <-received
+			if res.err != nil || !bytes.Equal(res.data, message) {
+				t.Errorf("the server received %d bytes, %v, want the %d bytes sent", len(res.data), res.err, len(message))
+			}
+		})
+	}
+}
+
+func TestConn_WrongKey(t *testing.T) {
+	clientEnd, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+	defer serverEnd.Close()
+	_, _, clientErr, serverErr := connPair(clientEnd, serverEnd, "SharedSecret", "OtherSecret")
+	if clientErr != ErrWrongKey || serverErr != ErrWrongKey {
+		t.Errorf("handshake errors = %v, %v, want %v", clientErr, serverErr, ErrWrongKey)
+	}
+	go clientEnd.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if _, err := Server(serverEnd, []byte("SharedSecret")); err != ErrHandshake {
+		t.Errorf("Server() with a bad hello error = %v, want %v", err, ErrHandshake)
+	}
+}
+
+func TestConn_Close(t *testing.T) {
+	clientEnd, serverEnd := net.Pipe()
+	client, server, clientErr, serverErr := connPair(clientEnd, serverEnd, "SharedSecret", "SharedSecret")
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake errors = %v, %v", clientErr, serverErr)
+	}
+	// The peer has gone, so the end of the data can not be sent.
+	server.Conn.Close()
+	if err := client.Close(); err != io.ErrClosedPipe {
+		t.Errorf("Conn.Close() error = %v, want %v", err, io.ErrClosedPipe)
+	}
+	if err := client.Close(); err != io.ErrClosedPipe {
+		t.Errorf("a second Conn.Close() error = %v, want %v", err, io.ErrClosedPipe)
+	}
+
+	// Close does not wait for a Write that is blocked because the peer is
+	// not reading, and the Write fails.
+	clientEnd, serverEnd = net.Pipe()
+	defer serverEnd.Close()
+	client, _, clientErr, serverErr = connPair(clientEnd, serverEnd, "SharedSecret", "SharedSecret")
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake errors = %v, %v", clientErr, serverErr)
+	}
+	written := make(chan error)
+	go func() {
+		_, err := client.Write(make([]byte, 100))
+		written <- err
+	}()
+	// Wait until the Write holds the lock of the sending direction.
+	for client.out.mu.TryLock() {
+		client.out.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	closed := make(chan error)
+	go func() { closed <- client.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(closeTimeout / 2):
+		t.Fatal("Conn.Close() did not return while a Write was blocked")
+	}
+	if err := <-written; err == nil {
+		t.Errorf("the blocked Conn.Write() did not fail")
+	}
+}
+
+func TestConn_Tampering(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(frame []byte) [][]byte // The frames sent in place of the first one.
+		wantN   int                         // The number of bytes read before the error.
+		wantErr error
+	}{
+		{name: "tct1", change: func(f []byte) [][]byte { return [][]byte{f, f} }, wantN: 100, wantErr: ErrFrameAuth},
+		{name: "tct2", change: func(f []byte) [][]byte { f[10] ^= 1; return [][]byte{f} }, wantErr: ErrFrameAuth},
+		{name: "tct3", change: func(f []byte) [][]byte { return [][]byte{f} }, wantN: 100, wantErr: io.ErrUnexpectedEOF},
+		{name: "tct4", change: func(f []byte) [][]byte { return [][]byte{f[:50]} }, wantErr: io.ErrUnexpectedEOF},
+		{name: "tct5", change: func(f []byte) [][]byte {
+			binary.BigEndian.PutUint32(f, uint32(MaxFrameSize+1))
+			return [][]byte{f}
+		}, wantErr: errFrameSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The client is connected to the server through a relay that
+			// changes the first frame sent by the client.
+			clientEnd, relayClient := net.Pipe()
+			relayServer, serverEnd := net.Pipe()
+			go io.Copy(relayClient, relayServer)
+			go func() {
+				defer relayServer.Close()
+				hello := make([]byte, helloSize)
+				if _, err := io.ReadFull(relayClient, hello); err != nil {
+					return
+				}
+				relayServer.Write(hello)
+				var length [4]byte
+				if _, err := io.ReadFull(relayClient, length[:]); err != nil {
+					return
+				}
+				frame := make([]byte, 4+int(binary.BigEndian.Uint32(length[:]))+32)
+				copy(frame, length[:])
+				if _, err := io.ReadFull(relayClient, frame[4:]); err != nil {
+					return
+				}
+				for _, f := range tt.change(frame) {
+					relayServer.Write(f)
+				}
+			}()
+			client, server, clientErr, serverErr := connPair(clientEnd, serverEnd, "SharedSecret", "SharedSecret")
+			if clientErr != nil || serverErr != nil {
+				t.Fatalf("handshake errors = %v, %v", clientErr, serverErr)
+			}
+			defer client.Conn.Close()
+			defer server.Conn.Close()
+			message := bytes.Repeat([]byte("x"), 100)
+			go client.Write(message)
+			got, err := io.ReadAll(server)
+			if len(got) != tt.wantN || err != tt.wantErr {
+				t.Errorf("io.ReadAll() = %d bytes, %v, want %d bytes, %v", len(got), err, tt.wantN, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the store of the next block number to use with each secret key, so
+// that no block number is used twice with the same key.
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CounterStore saves the next block number to use with each secret key.  The
+// keys are identified by the CounterKey of their engine.
+type CounterStore interface {
+	// Load returns the next block number to use for the key, or zero if
+	// none has been stored.
+	Load(keyID string) (*big.Int, error)
+	// Store saves the next block number to use for the key.
+	Store(keyID string, next *big.Int) error
+}
+
+// FileCounterStore is a CounterStore that keeps the block numbers in a JSON
+// file mapping each CounterKey to its next block number.  It is safe for
+// concurrent use by one process.
+type FileCounterStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileCounterStore returns a FileCounterStore using the file at path, which
+// is created when the first block number is stored.
+func NewFileCounterStore(path string) *FileCounterStore {
+	return &FileCounterStore{path: path}
+}
+
+// read returns the contents of the file.
+func (s *FileCounterStore) read() (map[string]*big.Int, error) {
+	counts := make(map[string]*big.Int)
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return counts, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// Load returns the next block number to use for the key.
+func (s *FileCounterStore) Load(keyID string) (*big.Int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	if next, ok := counts[keyID]; ok && next != nil {
+		return next, nil
+	}
+	return new(big.Int), nil
+}
+
+// Store saves the next block number to use for the key.  The file is replaced
+// by renaming a new file over it, so it is never left partly written.
+func (s *FileCounterStore) Store(keyID string, next *big.Int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts, err := s.read()
+	if err != nil {
+		return err
+	}
+	counts[keyID] = new(big.Int).Set(next)
+	data, err := json.MarshalIndent(counts, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileCounterStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counters.json")
+	store := NewFileCounterStore(path)
+	if next, err := store.Load("key1"); err != nil || next.Sign() != 0 {
+		t.Errorf("Load() without a file = %v, %v, want 0", next, err)
+	}
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	if err := store.Store("key1", huge); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	if err := store.Store("key2", big.NewInt(42)); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	// A new store reads the values from the file.
+	store = NewFileCounterStore(path)
+	for key, want := range map[string]*big.Int{"key1": huge, "key2": big.NewInt(42), "key3": new(big.Int)} {
+		if next, err := store.Load(key); err != nil || next.Cmp(want) != 0 {
+			t.Errorf("Load(%q) = %v, %v, want %v", key, next, err, want)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("the directory of the store has %d files, want 1", len(entries))
+	}
+	if err := os.WriteFile(path, []byte("not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load("key1"); err == nil {
+		t.Errorf("Load() of a damaged file did not fail")
+	}
+	if err := store.Store("key1", huge); err == nil {
+		t.Errorf("Store() into a damaged file did not fail")
+	}
+}
@@ -6,8 +6,10 @@ package tnt2engine
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math/big"
+	"sync"
 )
 
 // Define constants needed for tnt2engine
@@ -51,107 +53,220 @@ type Crypter interface {
 	ApplyG(CipherBlock) CipherBlock // decryption function
 }
 
+// BlockCrypter interface is implemented by crypters that can encrypt/decrypt
+// a block into a caller provided buffer.  This allows a block to pass through
+// the engine without allocating any memory.  The result is stored in
+// dst[:len(src)], so dst must be at least as long as src.  dst and src may
+// be the same slice.
+type BlockCrypter interface {
+	Crypter
+	ApplyFTo(dst, src CipherBlock) // encryption function
+	ApplyGTo(dst, src CipherBlock) // decryption function
+}
+
+// uint64Indexer is implemented by the crypters that can be positioned using
+// native arithmetic (see Tnt2Engine.SetIndexUint64 and Tnt2Engine.Skip).
+type uint64Indexer interface {
+	SetIndexUint64(idx uint64) // setter for the index value
+	Skip(n uint64)             // advance the index by n blocks
+}
+
 // Counter is a crypter that does not encrypt/decrypt any data but counts the
-// number of blocks that were encrypted.
+// number of blocks that were encrypted or decrypted, so that the index of the
+// next block is known in both directions.
 type Counter struct {
-	index *big.Int
+	index  *big.Int
+	blocks uint64 // The number of blocks processed since the last SetIndex.
+	bytes  uint64 // The number of bytes processed since the last SetIndex.
 }
 
 func (cntr *Counter) Update(random *Rand) {
 	// Do nothing.
 }
 
-// SetIndex - sets the initial index value
+// SetIndex - sets the initial index value and clears the number of blocks and
+// bytes processed.
 func (cntr *Counter) SetIndex(index *big.Int) {
 	cntr.index = new(big.Int).Set(index)
+	cntr.blocks, cntr.bytes = 0, 0
+}
+
+// SetIndexUint64 - sets the initial index value to a uint64 value and clears
+// the number of blocks and bytes processed.
+func (cntr *Counter) SetIndexUint64(idx uint64) {
+	cntr.index = new(big.Int).SetUint64(idx)
+	cntr.blocks, cntr.bytes = 0, 0
+}
+
+// Skip - advances the index by n blocks.  The skipped blocks are not counted
+// as processed.
+func (cntr *Counter) Skip(n uint64) {
+	cntr.index.Add(cntr.index, new(big.Int).SetUint64(n))
 }
 
-// Index - retrieves the current index value
+// Index - retrieves a copy of the current index value
 func (cntr *Counter) Index() *big.Int {
-	return cntr.index
+	if cntr.index == nil {
+		return nil
+	}
+	return new(big.Int).Set(cntr.index)
+}
+
+// Processed returns the number of blocks and bytes that were encrypted or
+// decrypted since the last call to SetIndex.
+func (cntr *Counter) Processed() (blocks, bytes uint64) {
+	return cntr.blocks, cntr.bytes
+}
+
+// advance counts a block of n bytes.
+func (cntr *Counter) advance(n int) {
+	cntr.index.Add(cntr.index, BigOne)
+	cntr.blocks++
+	cntr.bytes += uint64(n)
 }
 
 // ApplyF - increments the counter for each block that is encrypted.
 func (cntr *Counter) ApplyF(blk CipherBlock) CipherBlock {
-	cntr.index.Add(cntr.index, BigOne)
+	cntr.advance(len(blk))
 	return blk
 }
 
-// ApplyG - this function does nothing for a Counter during decryption.
+// ApplyG - increments the counter for each block that is decrypted.
 func (cntr *Counter) ApplyG(blk CipherBlock) CipherBlock {
+	cntr.advance(len(blk))
 	return blk
 }
 
+// ApplyFTo - copies src to dst and increments the counter.
+func (cntr *Counter) ApplyFTo(dst, src CipherBlock) {
+	copy(dst, src)
+	cntr.advance(len(src))
+}
+
+// ApplyGTo - copies src to dst and increments the counter.
+func (cntr *Counter) ApplyGTo(dst, src CipherBlock) {
+	copy(dst, src)
+	cntr.advance(len(src))
+}
+
 func (cntr *Counter) String() string {
 	return fmt.Sprint(cntr.index)
 }
 
-// SubBlock -  subtracts (not XOR) the key from the data to be decrypted
+// SubBlock -  subtracts (not XOR) the key from the data to be decrypted.
+// The subtraction is done 64 bits at a time (see subBlock256).
 func SubBlock(blk, key CipherBlock) CipherBlock {
-	var p int
-	for idx, val := range blk {
-		p = p + int(val) - int(key[idx])
-		blk[idx] = byte(p & 0xFF)
-		p >>= BitsPerByte
+	switch {
+	case len(blk) == CipherBlockBytes && len(key) >= CipherBlockBytes:
+		subBlock256((*[CipherBlockBytes]byte)(blk), (*[CipherBlockBytes]byte)(key))
+	case len(blk) > CipherBlockBytes:
+		subLong(blk, key)
+	default:
+		subShort(blk, key)
 	}
 	return blk
 }
 
 // AddBlock - adds (not XOR) the data to be encrypted with the key.
+// The addition is done 64 bits at a time (see addBlock256).
 func AddBlock(blk, key CipherBlock) CipherBlock {
-	var p int
-	for idx, val := range blk {
-		p += int(val) + int(key[idx])
-		blk[idx] = byte(p & 0xFF)
-		p >>= BitsPerByte
+	switch {
+	case len(blk) == CipherBlockBytes && len(key) >= CipherBlockBytes:
+		addBlock256((*[CipherBlockBytes]byte)(blk), (*[CipherBlockBytes]byte)(key))
+	case len(blk) > CipherBlockBytes:
+		addLong(blk, key)
+	default:
+		addShort(blk, key)
 	}
 	return blk
 }
 
-// EncryptMachine - set up a rotor, permutator, or counter to encrypt a block
-// read from the left (input channel) and send it out on the right (output channel)
-func EncryptMachine(ecm Crypter, left chan CipherBlock) chan CipherBlock {
+// cipherMachine sets up a rotor, permutator, or counter to encrypt (or decrypt)
+// the blocks read from the left channel and send them out on the right channel.
+// The machine exits after passing on a block with a length of zero, when the
+// left channel is closed, or when ctx is cancelled.  If wg is not nil, it is
+// marked done when the machine exits.
+func cipherMachine(ctx context.Context, ecm Crypter, left chan CipherBlock, wg *sync.WaitGroup, decrypt bool) chan CipherBlock {
 	if ecm == nil {
 		panic("ecm is nil")
 	}
 	right := make(chan CipherBlock)
+	if wg != nil {
+		wg.Add(1)
+	}
 	go func(ecm Crypter, left chan CipherBlock, right chan CipherBlock) {
+		if wg != nil {
+			defer wg.Done()
+		}
 		defer close(right)
+		bcm, isBlockCrypter := ecm.(BlockCrypter)
 		for {
-			inp := <-left
+			var inp CipherBlock
+			select {
+			case inp = <-left:
+			case <-ctx.Done():
+				return
+			}
+			if len(inp) > 0 {
+				switch {
+				case isBlockCrypter && decrypt:
+					bcm.ApplyGTo(inp, inp)
+				case isBlockCrypter:
+					bcm.ApplyFTo(inp, inp)
+				case decrypt:
+					inp = ecm.ApplyG(inp)
+				default:
+					inp = ecm.ApplyF(inp)
+				}
+			}
+			select {
+			case right <- inp:
+			case <-ctx.Done():
+				return
+			}
 			if len(inp) <= 0 {
-				right <- inp
-				ecm = nil
-				break
+				return
 			}
-			inp = ecm.ApplyF(inp)
-			right <- inp
 		}
 	}(ecm, left, right)
 	return right
 }
 
+// EncryptMachine - set up a rotor, permutator, or counter to encrypt a block
+// read from the left (input channel) and send it out on the right (output channel)
+func EncryptMachine(ecm Crypter, left chan CipherBlock) chan CipherBlock {
+	return cipherMachine(context.Background(), ecm, left, nil, false)
+}
+
 // DecryptMachine - set up a rotor, permutator, or counter to decrypt a block
 // read from the left (input channel) and send it out on the right (output channel)
 func DecryptMachine(ecm Crypter, left chan CipherBlock) chan CipherBlock {
-	if ecm == nil {
-		panic("ecm is nil")
+	return cipherMachine(context.Background(), ecm, left, nil, true)
+}
+
+// createCipherMachine - Chain the encryption (or decryption) machines together,
+// using channels to pass the data to the individual machines.  The decryption
+// machines are chained in reverse order.  Every machine exits when ctx is
+// cancelled and is added to wg (if it is not nil).
+func createCipherMachine(ctx context.Context, wg *sync.WaitGroup, decrypt bool, ecms ...Crypter) (left chan CipherBlock, right chan CipherBlock) {
+	if len(ecms) == 0 {
+		if decrypt {
+			panic("you must give at least one decryption device!")
+		}
+		panic("you must give at least one encryption device!")
 	}
-	right := make(chan CipherBlock)
-	go func(ecm Crypter, left chan CipherBlock, right chan CipherBlock) {
-		defer close(right)
-		for {
-			inp := <-left
-			if len(inp) <= 0 {
-				right <- inp
-				ecm = nil
-				break
-			}
-			inp = ecm.ApplyG(inp)
-			right <- inp
+	left = make(chan CipherBlock)
+	right = left
+	if decrypt {
+		for idx := len(ecms) - 1; idx >= 0; idx-- {
+			right = cipherMachine(ctx, ecms[idx], right, wg, true)
 		}
-	}(ecm, left, right)
-	return right
+	} else {
+		for _, ecm := range ecms {
+			right = cipherMachine(ctx, ecm, right, wg, false)
+		}
+	}
+	return
 }
 
 // CreateEncryptMachine - Chain the encryption machines together, using channels to pass
@@ -159,17 +274,7 @@ func DecryptMachine(ecm Crypter, left chan CipherBlock) chan CipherBlock {
 // The data is entered in the 'left' channel and the encrypted data is read from the
 // 'right' channel.
 func createEncryptMachine(ecms ...Crypter) (left chan CipherBlock, right chan CipherBlock) {
-	if ecms != nil {
-		idx := 0
-		left = make(chan CipherBlock)
-		right = EncryptMachine(ecms[idx], left)
-		for idx++; idx < len(ecms); idx++ {
-			right = EncryptMachine(ecms[idx], right)
-		}
-	} else {
-		panic("you must give at least one encryption device!")
-	}
-	return
+	return createCipherMachine(context.Background(), nil, false, ecms...)
 }
 
 // CreateDecryptMachine - Chain the decryption machines together (in reverse order), using
@@ -177,15 +282,5 @@ func createEncryptMachine(ecms ...Crypter) (left chan CipherBlock, right chan Ci
 // The encrypted data is entered in the 'left' channel and the plaintext data is read from
 // the 'right' channel.
 func createDecryptMachine(ecms ...Crypter) (left chan CipherBlock, right chan CipherBlock) {
-	if ecms != nil {
-		idx := len(ecms) - 1
-		left = make(chan CipherBlock)
-		right = DecryptMachine(ecms[idx], left)
-		for idx--; idx >= 0; idx-- {
-			right = DecryptMachine(ecms[idx], right)
-		}
-	} else {
-		panic("you must give at least one decryption device!")
-	}
-	return
+	return createCipherMachine(context.Background(), nil, true, ecms...)
 }
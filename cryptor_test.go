@@ -143,7 +143,7 @@ func TestCounter_ApplyG(t *testing.T) {
 			cntr:  tntMachine.engine[len(tntMachine.engine)-1],
 			args:  args{make(CipherBlock, CipherBlockBytes)},
 			want:  make(CipherBlock, CipherBlockBytes),
-			want2: BigZero,
+			want2: BigOne,
 		},
 	}
 	for _, tt := range tests {
@@ -159,6 +159,85 @@ func TestCounter_ApplyG(t *testing.T) {
 	tntMachine = *new(Tnt2Engine)
 }
 
+func TestCounter_ApplyFTo(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   CipherBlock
+		want  CipherBlock
+		want2 *big.Int
+	}{
+		{
+			name:  "tcafto1",
+			src:   CipherBlock{1, 2, 3, 4},
+			want:  CipherBlock{1, 2, 3, 4},
+			want2: BigOne,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cntr := new(Counter)
+			cntr.SetIndex(BigZero)
+			dst := make(CipherBlock, len(tt.src))
+			cntr.ApplyFTo(dst, tt.src)
+			if !reflect.DeepEqual(dst, tt.want) {
+				t.Errorf("Counter.ApplyFTo() = %v, want %v", dst, tt.want)
+			}
+			if got := cntr.Index(); got.Cmp(tt.want2) != 0 {
+				t.Errorf("Counter.Index() = %v, want %v", got, tt.want2)
+			}
+		})
+	}
+}
+
+func TestCounter_ApplyGTo(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   CipherBlock
+		want  CipherBlock
+		want2 *big.Int
+	}{
+		{
+			name:  "tcagto1",
+			src:   CipherBlock{1, 2, 3, 4},
+			want:  CipherBlock{1, 2, 3, 4},
+			want2: BigOne,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cntr := new(Counter)
+			cntr.SetIndex(BigZero)
+			dst := make(CipherBlock, len(tt.src))
+			cntr.ApplyGTo(dst, tt.src)
+			if !reflect.DeepEqual(dst, tt.want) {
+				t.Errorf("Counter.ApplyGTo() = %v, want %v", dst, tt.want)
+			}
+			if got := cntr.Index(); got.Cmp(tt.want2) != 0 {
+				t.Errorf("Counter.Index() = %v, want %v", got, tt.want2)
+			}
+		})
+	}
+}
+
+func TestCounter_Processed(t *testing.T) {
+	cntr := new(Counter)
+	cntr.SetIndex(big.NewInt(10))
+	cntr.ApplyF(make(CipherBlock, CipherBlockBytes))
+	cntr.ApplyFTo(make(CipherBlock, CipherBlockBytes), make(CipherBlock, CipherBlockBytes))
+	cntr.ApplyG(make(CipherBlock, 5))
+	cntr.ApplyGTo(make(CipherBlock, 7), make(CipherBlock, 7))
+	if blocks, bytes := cntr.Processed(); blocks != 4 || bytes != 2*uint64(CipherBlockBytes)+12 {
+		t.Errorf("Counter.Processed() = %d, %d, want 4, %d", blocks, bytes, 2*CipherBlockBytes+12)
+	}
+	if got := cntr.Index(); got.Cmp(big.NewInt(14)) != 0 {
+		t.Errorf("Counter.Index() = %s, want 14", got)
+	}
+	cntr.SetIndex(big.NewInt(3))
+	if blocks, bytes := cntr.Processed(); blocks != 0 || bytes != 0 {
+		t.Errorf("Counter.Processed() after SetIndex = %d, %d, want 0, 0", blocks, bytes)
+	}
+}
+
 func TestSubBlock(t *testing.T) {
 	type args struct {
 		blk CipherBlock
@@ -0,0 +1,285 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define envelope encryption, where data is encrypted by an engine created from
+// a random data secret, and the data secret is stored wrapped (encrypted) by
+// one or more master engines.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/big"
+)
+
+// The envelope is encoded as:
+//
+//	magic      [4]byte  "TNTE"
+//	version    byte     EnvelopeVersion
+//	slotCount  byte     the number of key slots
+//
+// followed by the key slots, each encoded as:
+//
+//	idLen      byte     the length of keyID
+//	keyID      []byte   the CounterKey of the master engine
+//	indexLen   byte     the length of index
+//	index      []byte   big-endian block number the data secret was wrapped at
+//	wrapped    [32]byte the data secret encrypted by the master engine
+//	tag        [32]byte HMAC-SHA256 over the slot, keyed by a key derived
+//	                    from the secret state of the master engine
+//
+// An envelope is normally followed by a stream encrypted by the data engine.
+const (
+	EnvelopeVersion byte = 1
+	// DataSecretSize is the size of the random data secret.
+	DataSecretSize = CipherBlockBytes
+	// MaxKeySlots is the largest number of key slots in an envelope.
+	MaxKeySlots = 255
+)
+
+var envelopeMagic = [4]byte{'T', 'N', 'T', 'E'}
+
+// Errors returned by the Envelope functions.
+var (
+	ErrEnvelope      = errors.New("tnt2engine: invalid envelope")
+	ErrNoKeySlot     = errors.New("tnt2engine: no key slot for the master engine")
+	ErrKeySlotExists = errors.New("tnt2engine: a key slot for the master engine already exists")
+	errLastKeySlot   = errors.New("tnt2engine: the last key slot can not be removed")
+	errTooManySlots  = errors.New("tnt2engine: too many key slots")
+)
+
+// KeySlot holds the data secret of an envelope wrapped by one master engine.
+type KeySlot struct {
+	KeyID   string   // The CounterKey of the master engine.
+	Index   *big.Int // The block number the data secret was wrapped at.
+	Wrapped []byte   // The data secret encrypted by the master engine.
+	Tag     []byte   // Authenticates the slot.
+}
+
+// marshal returns the slot as it is encoded in an envelope.
+func (s *KeySlot) marshal() []byte {
+	index := s.Index.Bytes()
+	buf := make([]byte, 0, 2+len(s.KeyID)+len(index)+len(s.Wrapped)+len(s.Tag))
+	buf = append(buf, byte(len(s.KeyID)))
+	buf = append(buf, s.KeyID...)
+	buf = append(buf, byte(len(index)))
+	buf = append(buf, index...)
+	buf = append(buf, s.Wrapped...)
+	return append(buf, s.Tag...)
+}
+
+// slotTag returns the tag of the slot, computed with a key derived from the
+// master engine.
+func slotTag(master *Tnt2Engine, s *KeySlot) []byte {
+	untagged := *s
+	untagged.Tag = nil
+	mac := hmac.New(sha256.New, master.deriveKey("envelope key slot"))
+	mac.Write(untagged.marshal())
+	return mac.Sum(nil)
+}
+
+// Envelope holds the key slots that each wrap the data secret.
+type Envelope struct {
+	Slots []KeySlot
+}
+
+// NewEnvelope creates a random data secret, wraps it with each of the master
+// engines, and returns the envelope and the data engine created from the data
+// secret.  Each master engine wraps the secret at its current index and is
+// left at the block following it, as it is after encrypting a message.
+func NewEnvelope(masters ...*Tnt2Engine) (*Envelope, *Tnt2Engine, error) {
+	if len(masters) == 0 {
+		return nil, nil, ErrNoKeySlot
+	}
+	secret := make([]byte, DataSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, err
+	}
+	env := new(Envelope)
+	for _, master := range masters {
+		if err := env.wrap(master, secret); err != nil {
+			return nil, nil, err
+		}
+	}
+	return env, dataEngine(secret), nil
+}
+
+// dataEngine returns an engine created from the data secret.
+func dataEngine(secret []byte) *Tnt2Engine {
+	e := new(Tnt2Engine)
+	e.Init(secret, "")
+	return e
+}
+
+// find returns the index of the slot of the master engine, or -1.
+func (env *Envelope) find(master *Tnt2Engine) int {
+	keyID := master.CounterKey()
+	for i := range env.Slots {
+		if env.Slots[i].KeyID == keyID {
+			return i
+		}
+	}
+	return -1
+}
+
+// wrap adds a slot holding secret wrapped by master.
+func (env *Envelope) wrap(master *Tnt2Engine, secret []byte) error {
+	if env.find(master) >= 0 {
+		return ErrKeySlotExists
+	}
+	if len(env.Slots) >= MaxKeySlots {
+		return errTooManySlots
+	}
+	slot := KeySlot{KeyID: master.CounterKey(), Index: master.Index()}
+	wrapped, err := runMachine(master, "E", secret)
+	if err != nil {
+		return err
+	}
+	slot.Wrapped = wrapped
+	slot.Tag = slotTag(master, &slot)
+	env.Slots = append(env.Slots, slot)
+	return nil
+}
+
+// unwrap returns the data secret using the slot of the master engine.  It
+// returns ErrNoKeySlot if there is no slot for master, and ErrWrongKey if the
+// slot fails authentication.
+func (env *Envelope) unwrap(master *Tnt2Engine) ([]byte, error) {
+	i := env.find(master)
+	if i < 0 {
+		return nil, ErrNoKeySlot
+	}
+	slot := &env.Slots[i]
+	if !hmac.Equal(slot.Tag, slotTag(master, slot)) {
+		return nil, ErrWrongKey
+	}
+	master.SetIndex(slot.Index)
+	return runMachine(master, "D", slot.Wrapped)
+}
+
+// Open returns the data engine of the envelope using the slot of the master
+// engine.  The index of master is changed.
+func (env *Envelope) Open(master *Tnt2Engine) (*Tnt2Engine, error) {
+	secret, err := env.unwrap(master)
+	if err != nil {
+		return nil, err
+	}
+	return dataEngine(secret), nil
+}
+
+// AddSlot wraps the data secret, which is unwrapped using the slot of the
+// master engine unlock, with the master engine master.  This grants access to
+// the data to the holder of the secret key of master without encrypting the
+// data again.
+func (env *Envelope) AddSlot(unlock, master *Tnt2Engine) error {
+	if env.find(master) >= 0 {
+		return ErrKeySlotExists
+	}
+	secret, err := env.unwrap(unlock)
+	if err != nil {
+		return err
+	}
+	return env.wrap(master, secret)
+}
+
+// RemoveSlot removes the slot with the given key ID (the CounterKey of the
+// master engine).  The last slot can not be removed.  To rotate the secret key
+// of a master engine, add a slot for the new engine and remove the slot of the
+// old one.
+func (env *Envelope) RemoveSlot(keyID string) error {
+	for i := range env.Slots {
+		if env.Slots[i].KeyID == keyID {
+			if len(env.Slots) == 1 {
+				return errLastKeySlot
+			}
+			env.Slots = append(env.Slots[:i], env.Slots[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNoKeySlot
+}
+
+// MarshalBinary returns the envelope encoded as it is written to a file.
+func (env *Envelope) MarshalBinary() ([]byte, error) {
+	if len(env.Slots) > MaxKeySlots {
+		return nil, errTooManySlots
+	}
+	buf := make([]byte, 0, 6)
+	buf = append(buf, envelopeMagic[:]...)
+	buf = append(buf, EnvelopeVersion, byte(len(env.Slots)))
+	for i := range env.Slots {
+		buf = append(buf, env.Slots[i].marshal()...)
+	}
+	return buf, nil
+}
+
+// WriteTo writes the encoded envelope to w.
+func (env *Envelope) WriteTo(w io.Writer) (int64, error) {
+	buf, err := env.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadEnvelope reads an encoded envelope from r.  Only the envelope is read
+// from r, so the data following it can be read from r next.
+func ReadEnvelope(r io.Reader) (*Envelope, error) {
+	var buf [6]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, ErrEnvelope
+	}
+	if [4]byte(buf[:4]) != envelopeMagic || buf[4] != EnvelopeVersion || buf[5] == 0 {
+		return nil, ErrEnvelope
+	}
+	// read returns a field of n bytes, or of the length in the next byte if
+	// n is negative.
+	read := func(n int) ([]byte, error) {
+		if n < 0 {
+			var l [1]byte
+			if _, err := io.ReadFull(r, l[:]); err != nil {
+				return nil, ErrEnvelope
+			}
+			n = int(l[0])
+		}
+		field := make([]byte, n)
+		if _, err := io.ReadFull(r, field); err != nil {
+			return nil, ErrEnvelope
+		}
+		return field, nil
+	}
+	env := new(Envelope)
+	env.Slots = make([]KeySlot, buf[5])
+	for i := range env.Slots {
+		var fields [4][]byte
+		for j, n := range []int{-1, -1, DataSecretSize, sha256.Size} {
+			field, err := read(n)
+			if err != nil {
+				return nil, err
+			}
+			fields[j] = field
+		}
+		env.Slots[i] = KeySlot{string(fields[0]), new(big.Int).SetBytes(fields[1]), fields[2], fields[3]}
+	}
+	return env, nil
+}
+
+// UnmarshalBinary decodes an envelope encoded by MarshalBinary.
+func (env *Envelope) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	decoded, err := ReadEnvelope(r)
+	if err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return ErrEnvelope
+	}
+	*env = *decoded
+	return nil
+}
@@ -0,0 +1,124 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"bytes"
+	"io"
+	"math/big"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	masters := make([]*Tnt2Engine, 3)
+	for i, key := range []string{"Alice", "Bob", "Carol"} {
+		masters[i] = new(Tnt2Engine)
+		masters[i].Init([]byte(key), "")
+		masters[i].SetIndex(big.NewInt(int64(100 * i)))
+	}
+	env, data, err := NewEnvelope(masters[0], masters[1])
+	if err != nil {
+		t.Fatalf("NewEnvelope() error = %v", err)
+	}
+	if got := masters[1].Index(); got.Cmp(big.NewInt(101)) != 0 {
+		t.Errorf("Index() of the master after NewEnvelope() = %s, want 101", got)
+	}
+	plaintext := []byte("The data is only encrypted once.")
+	var file bytes.Buffer
+	envLen, err := env.WriteTo(&file)
+	if err != nil {
+		t.Fatalf("Envelope.WriteTo() error = %v", err)
+	}
+	file.Write(encryptStream(t, data, plaintext, DefaultChunkSize, 7))
+
+	// open reads the envelope from the file and decrypts the stream after it.
+	open := func(file []byte, master *Tnt2Engine) ([]byte, error) {
+		r := bytes.NewReader(file)
+		env, err := ReadEnvelope(r)
+		if err != nil {
+			return nil, err
+		}
+		data, err := env.Open(master)
+		if err != nil {
+			return nil, err
+		}
+		sr, err := NewStreamReader(r, data)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(sr)
+	}
+	for i, master := range masters[:2] {
+		if got, err := open(file.Bytes(), master); err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("master %d: open() = %q, %v", i, got, err)
+		}
+	}
+	if _, err = open(file.Bytes(), masters[2]); err != ErrNoKeySlot {
+		t.Errorf("open() without a key slot error = %v, want %v", err, ErrNoKeySlot)
+	}
+
+	// Grant access to Carol and remove Alice by rewriting the envelope.
+	if err = env.AddSlot(masters[1], masters[2]); err != nil {
+		t.Fatalf("Envelope.AddSlot() error = %v", err)
+	}
+	if err = env.AddSlot(masters[1], masters[2]); err != ErrKeySlotExists {
+		t.Errorf("second Envelope.AddSlot() error = %v, want %v", err, ErrKeySlotExists)
+	}
+	if err = env.RemoveSlot(masters[0].CounterKey()); err != nil {
+		t.Fatalf("Envelope.RemoveSlot() error = %v", err)
+	}
+	if err = env.RemoveSlot(masters[0].CounterKey()); err != ErrNoKeySlot {
+		t.Errorf("second Envelope.RemoveSlot() error = %v, want %v", err, ErrNoKeySlot)
+	}
+	var rewritten bytes.Buffer
+	env.WriteTo(&rewritten)
+	rewritten.Write(file.Bytes()[envLen:])
+	for i, want := range []error{ErrNoKeySlot, nil, nil} {
+		if got, err := open(rewritten.Bytes(), masters[i]); err != want || (err == nil && !bytes.Equal(got, plaintext)) {
+			t.Errorf("master %d: open() of the rewritten file = %q, %v, want error %v", i, got, err, want)
+		}
+	}
+	if err = env.RemoveSlot(masters[1].CounterKey()); err != nil {
+		t.Fatalf("Envelope.RemoveSlot() error = %v", err)
+	}
+	if err = env.RemoveSlot(masters[2].CounterKey()); err != errLastKeySlot {
+		t.Errorf("Envelope.RemoveSlot() of the last slot error = %v, want %v", err, errLastKeySlot)
+	}
+}
+
+func TestEnvelope_MarshalBinary(t *testing.T) {
+	var master, other Tnt2Engine
+	master.Init([]byte("SecretKey"), "")
+	other.Init([]byte("OtherKey"), "")
+	env, _, err := NewEnvelope(&master)
+	if err != nil {
+		t.Fatalf("NewEnvelope() error = %v", err)
+	}
+	encoded, err := env.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Envelope.MarshalBinary() error = %v", err)
+	}
+	var decoded Envelope
+	if err = decoded.UnmarshalBinary(encoded); err != nil {
+		t.Fatalf("Envelope.UnmarshalBinary() error = %v", err)
+	}
+	if reencoded, _ := decoded.MarshalBinary(); !bytes.Equal(reencoded, encoded) {
+		t.Errorf("Envelope.UnmarshalBinary() did not decode the envelope")
+	}
+	for _, bad := range [][]byte{encoded[:5], encoded[:len(encoded)-1], append(encoded, 0), {'T', 'N', 'T', 'E', EnvelopeVersion, 0}} {
+		if err = new(Envelope).UnmarshalBinary(bad); err != ErrEnvelope {
+			t.Errorf("Envelope.UnmarshalBinary(%x) error = %v, want %v", bad, err, ErrEnvelope)
+		}
+	}
+	// A changed slot, or a slot claimed by another engine, fails
+	// authentication.
+	decoded.Slots[0].Wrapped[0] ^= 1
+	if _, err = decoded.Open(&master); err != ErrWrongKey {
+		t.Errorf("Envelope.Open() of a changed slot error = %v, want %v", err, ErrWrongKey)
+	}
+	env.Slots[0].KeyID = other.CounterKey()
+	if _, err = env.Open(&other); err != ErrWrongKey {
+		t.Errorf("Envelope.Open() with the wrong master error = %v, want %v", err, ErrWrongKey)
+	}
+}
@@ -0,0 +1,276 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the key agreement handshake, which creates the engines of a Conn
+// from X25519 keys instead of a shared secret.
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+)
+
+// The key agreement handshake starts with the client sending a hello, and the
+// server replying with its own hello:
+//
+//	magic      [4]byte  "TNTK"
+//	version    byte     KeyAgreementVersion
+//	flags      byte     kexStatic if a static key follows
+//	ephemeral  [32]byte a new X25519 public key
+//	static     [32]byte the X25519 static key of the sender (optional)
+//
+// Both sides then compute the X25519 shared secrets of the ephemeral keys, of
+// the client ephemeral key and the server static key, and of the client static
+// key and the server ephemeral key (the last two only if those static keys were
+// sent).  The secret used to create the engines, the block numbers of the
+// first frames of each direction, and the keys of the finished messages are
+// derived from the shared secrets using HKDF (RFC 5869) with HMAC-SHA256,
+// salted with the hash of both hellos.
+//
+// The client then sends its finished message, HMAC-SHA256 over the hash of
+// both hellos, and the server replies with its own.  A side whose static key
+// was sent can only compute the finished message if it holds the private key,
+// so it is authenticated to its peer.  After the handshake, the data is sent in
+// the frames described in conn.go.
+const (
+	KeyAgreementVersion byte = 1
+	kexStatic           byte = 1
+	kexKeySize               = 32
+)
+
+var kexMagic = [4]byte{'T', 'N', 'T', 'K'}
+
+// Errors returned by the key agreement handshake.
+var (
+	ErrPeerAuth = errors.New("tnt2engine: the peer failed authentication")
+	errKexCurve = errors.New("tnt2engine: the key agreement needs X25519 keys")
+)
+
+// KeyAgreementConfig holds the optional long-term keys used by ClientECDH and
+// ServerECDH.  Without them, the connection is encrypted but neither side is
+// authenticated.
+type KeyAgreementConfig struct {
+	// Static is the X25519 static key of this side.  If it is set, the
+	// peer can authenticate this side using the public key.
+	Static *ecdh.PrivateKey
+	// PeerStatic is the X25519 public key the peer must hold the private
+	// key of.  If it is nil, any peer is accepted, and its static key (if
+	// any) is returned by Conn.PeerStatic.
+	PeerStatic *ecdh.PublicKey
+}
+
+// ClientECDH performs the key agreement handshake over conn as the client and
+// returns the encrypted connection.  It returns ErrPeerAuth if the server does
+// not hold the private key of config.PeerStatic, or rejected the client.
+// config may be nil.  As with Client, the caller must set a deadline on conn
+// to limit the time the handshake takes.
+func ClientECDH(conn net.Conn, config *KeyAgreementConfig) (*Conn, error) {
+	return kexHandshake(conn, config, true)
+}
+
+// ServerECDH performs the key agreement handshake over conn as the server and
+// returns the encrypted connection.  It returns ErrPeerAuth if the client does
+// not hold the private key of config.PeerStatic.  config may be nil.  As with
+// Client, the caller must set a deadline on conn to limit the time the
+// handshake takes.
+func ServerECDH(conn net.Conn, config *KeyAgreementConfig) (*Conn, error) {
+	return kexHandshake(conn, config, false)
+}
+
+// PeerStatic returns the static key the peer authenticated with during the key
+// agreement handshake, or nil if there was none.
+func (c *Conn) PeerStatic() *ecdh.PublicKey {
+	return c.peerStatic
+}
+
+// kexHello is the content of a key agreement hello.
+type kexHello struct {
+	ephemeral, static *ecdh.PublicKey
+}
+
+// marshal returns the hello as it is sent.
+func (h *kexHello) marshal() []byte {
+	b := make([]byte, 0, 6+2*kexKeySize)
+	b = append(b, kexMagic[:]...)
+	b = append(b, KeyAgreementVersion, 0)
+	b = append(b, h.ephemeral.Bytes()...)
+	if h.static != nil {
+		b[5] |= kexStatic
+		b = append(b, h.static.Bytes()...)
+	}
+	return b
+}
+
+// readKexHello reads a hello from r and returns it along with the bytes read.
+func readKexHello(r io.Reader) (*kexHello, []byte, error) {
+	b := make([]byte, 6+kexKeySize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, nil, err
+	}
+	if [4]byte(b[:4]) != kexMagic || b[4] != KeyAgreementVersion || b[5]&^kexStatic != 0 {
+		return nil, nil, ErrHandshake
+	}
+	if b[5]&kexStatic != 0 {
+		b = append(b, make([]byte, kexKeySize)...)
+		if _, err := io.ReadFull(r, b[6+kexKeySize:]); err != nil {
+			return nil, nil, err
+		}
+	}
+	h := new(kexHello)
+	var err error
+	if h.ephemeral, err = ecdh.X25519().NewPublicKey(b[6 : 6+kexKeySize]); err != nil {
+		return nil, nil, ErrHandshake
+	}
+	if len(b) > 6+kexKeySize {
+		if h.static, err = ecdh.X25519().NewPublicKey(b[6+kexKeySize:]); err != nil {
+			return nil, nil, ErrHandshake
+		}
+	}
+	return h, b, nil
+}
+
+// kexHandshake performs the key agreement handshake over conn and returns the
+// encrypted connection.
+func kexHandshake(conn net.Conn, config *KeyAgreementConfig, client bool) (*Conn, error) {
+	if config == nil {
+		config = new(KeyAgreementConfig)
+	}
+	if (config.Static != nil && config.Static.Curve() != ecdh.X25519()) ||
+		(config.PeerStatic != nil && config.PeerStatic.Curve() != ecdh.X25519()) {
+		return nil, errKexCurve
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hello := &kexHello{ephemeral: ephemeral.PublicKey()}
+	if config.Static != nil {
+		hello.static = config.Static.PublicKey()
+	}
+	helloBytes := hello.marshal()
+	if client {
+		if _, err = conn.Write(helloBytes); err != nil {
+			return nil, err
+		}
+	}
+	peer, peerBytes, err := readKexHello(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !client {
+		if _, err = conn.Write(helloBytes); err != nil {
+			return nil, err
+		}
+	}
+	// Compute the shared secrets in the same order on both sides.
+	ikm, err := ephemeral.ECDH(peer.ephemeral)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	var clientStatic, serverStatic []byte
+	if client && peer.static != nil {
+		serverStatic, err = ephemeral.ECDH(peer.static)
+	} else if !client && config.Static != nil {
+		serverStatic, err = config.Static.ECDH(peer.ephemeral)
+	}
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	if client && config.Static != nil {
+		clientStatic, err = config.Static.ECDH(peer.ephemeral)
+	} else if !client && peer.static != nil {
+		clientStatic, err = ephemeral.ECDH(peer.static)
+	}
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	ikm = append(append(ikm, serverStatic...), clientStatic...)
+	h := sha256.New()
+	if client {
+		h.Write(helloBytes)
+		h.Write(peerBytes)
+	} else {
+		h.Write(peerBytes)
+		h.Write(helloBytes)
+	}
+	transcript := h.Sum(nil)
+	prk := hkdfExtract(transcript, ikm)
+	c := newConn(conn, hkdfExpand(prk, "tnt2engine secret", 32), client)
+	c.transcript = transcript
+	c.peerStatic = peer.static
+	clientStart := new(big.Int).SetBytes(hkdfExpand(prk, "tnt2engine client start", 16))
+	serverStart := new(big.Int).SetBytes(hkdfExpand(prk, "tnt2engine server start", 16))
+	clientFinished := finishedMessage(prk, "tnt2engine client finished", transcript)
+	serverFinished := finishedMessage(prk, "tnt2engine server finished", transcript)
+	peerFinished := make([]byte, sha256.Size)
+	if client {
+		c.out.next, c.in.next = clientStart, serverStart
+		if _, err = conn.Write(clientFinished); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(conn, peerFinished); err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(peerFinished, serverFinished) {
+			return nil, ErrPeerAuth
+		}
+	} else {
+		c.out.next, c.in.next = serverStart, clientStart
+		if _, err = io.ReadFull(conn, peerFinished); err != nil {
+			return nil, err
+		}
+		// The server replies even if the client failed, so that both sides
+		// report ErrPeerAuth.
+		if _, err = conn.Write(serverFinished); err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(peerFinished, clientFinished) {
+			return nil, ErrPeerAuth
+		}
+	}
+	// The peer is only known to hold the private key of the static key it
+	// sent once its finished message is checked.
+	if config.PeerStatic != nil && (peer.static == nil || !peer.static.Equal(config.PeerStatic)) {
+		return nil, ErrPeerAuth
+	}
+	return c, nil
+}
+
+// finishedMessage returns the finished message of one side, keyed by a key
+// derived from prk using label.
+func finishedMessage(prk []byte, label string, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, hkdfExpand(prk, label, sha256.Size))
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
+
+// hkdfExtract returns the pseudorandom key extracted from ikm (see RFC 5869).
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// hkdfExpand returns length bytes of keying material expanded from prk for the
+// purpose given by info (see RFC 5869).  length must be at most 255 *
+// sha256.Size.
+func hkdfExpand(prk []byte, info string, length int) []byte {
+	mac := hmac.New(sha256.New, prk)
+	var okm, t []byte
+	for i := byte(1); len(okm) < length; i++ {
+		mac.Reset()
+		mac.Write(t)
+		io.WriteString(mac, info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		okm = append(okm, t...)
+	}
+	return okm[:length]
+}
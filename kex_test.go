@@ -0,0 +1,174 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+)
+
+// kexPair performs the key agreement handshake over net.Pipe and returns the
+// encrypted client and server connections.
+func kexPair(clientConfig, serverConfig *KeyAgreementConfig) (client, server *Conn, clientErr, serverErr error) {
+	clientEnd, serverEnd := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		server, serverErr = ServerECDH(serverEnd, serverConfig)
+		if serverErr != nil {
+			serverEnd.Close()
+		}
+		close(done)
+	}()
+	client, clientErr = ClientECDH(clientEnd, clientConfig)
+	if clientErr != nil {
+		clientEnd.Close()
+	}
+	<-done
+	return client, server, clientErr, serverErr
+}
+
+func TestKeyAgreement(t *testing.T) {
+	clientKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	serverKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	otherKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	tests := []struct {
+		name                           string
+		clientConfig, serverConfig     *KeyAgreementConfig
+		wantClientErr, wantServerErr   error
+		wantClientPeer, wantServerPeer *ecdh.PublicKey
+	}{
+		{
+			name: "tka1",
+		},
+		{
+			name:           "tka2",
+			clientConfig:   &KeyAgreementConfig{PeerStatic: serverKey.PublicKey()},
+			serverConfig:   &KeyAgreementConfig{Static: serverKey},
+			wantClientPeer: serverKey.PublicKey(),
+		},
+		{
+			name:           "tka3",
+			clientConfig:   &KeyAgreementConfig{Static: clientKey, PeerStatic: serverKey.PublicKey()},
+			serverConfig:   &KeyAgreementConfig{Static: serverKey, PeerStatic: clientKey.PublicKey()},
+			wantClientPeer: serverKey.PublicKey(),
+			wantServerPeer: clientKey.PublicKey(),
+		},
+		{
+			name:           "tka4",
+			clientConfig:   &KeyAgreementConfig{Static: clientKey},
+			serverConfig:   &KeyAgreementConfig{},
+			wantServerPeer: clientKey.PublicKey(),
+		},
+		{
+			name:          "tka5",
+			clientConfig:  &KeyAgreementConfig{PeerStatic: serverKey.PublicKey()},
+			serverConfig:  &KeyAgreementConfig{Static: otherKey},
+			wantClientErr: ErrPeerAuth,
+		},
+		{
+			name:          "tka6",
+			clientConfig:  &KeyAgreementConfig{PeerStatic: serverKey.PublicKey()},
+			wantClientErr: ErrPeerAuth,
+		},
+		{
+			name:          "tka7",
+			clientConfig:  &KeyAgreementConfig{Static: otherKey},
+			serverConfig:  &KeyAgreementConfig{PeerStatic: clientKey.PublicKey()},
+			wantServerErr: ErrPeerAuth,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server, clientErr, serverErr := kexPair(tt.clientConfig, tt.serverConfig)
+			if clientErr != tt.wantClientErr || serverErr != tt.wantServerErr {
+				t.Fatalf("handshake errors = %v, %v, want %v, %v", clientErr, serverErr, tt.wantClientErr, tt.wantServerErr)
+			}
+			if client != nil {
+				defer client.Conn.Close()
+			}
+			if server != nil {
+				defer server.Conn.Close()
+			}
+			if clientErr != nil || serverErr != nil {
+				return
+			}
+			if got := client.PeerStatic(); !keyEqual(got, tt.wantClientPeer) {
+				t.Errorf("client PeerStatic() = %v, want %v", got, tt.wantClientPeer)
+			}
+			if got := server.PeerStatic(); !keyEqual(got, tt.wantServerPeer) {
+				t.Errorf("server PeerStatic() = %v, want %v", got, tt.wantServerPeer)
+			}
+			if client.out.next.Cmp(server.in.next) != 0 || client.in.next.Cmp(server.out.next) != 0 {
+				t.Errorf("the block numbers of the first frames differ")
+			}
+			if client.out.next.Cmp(client.in.next) == 0 {
+				t.Errorf("both directions start at the same block number")
+			}
+			message := []byte("The quick brown fox jumps over the lazy dog.")
+			go func() {
+				client.Write(message)
+				client.Close()
+			}()
+			if got, err := io.ReadAll(server); err != nil || !bytes.Equal(got, message) {
+				t.Errorf("io.ReadAll() = %q, %v, want %q", got, err, message)
+			}
+		})
+	}
+}
+
+// keyEqual returns true if both keys are nil or are equal.
+func keyEqual(a, b *ecdh.PublicKey) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(b)
+}
+
+func TestKeyAgreement_impersonation(t *testing.T) {
+	// A client that sends the static key of another client, without holding
+	// its private key, can not compute the finished message.
+	clientKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	ephemeral, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	clientEnd, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+	go func() {
+		hello := &kexHello{ephemeral: ephemeral.PublicKey(), static: clientKey.PublicKey()}
+		clientEnd.Write(hello.marshal())
+		if _, _, err := readKexHello(clientEnd); err != nil {
+			return
+		}
+		clientEnd.Write(make([]byte, 32))
+		io.Copy(io.Discard, clientEnd)
+	}()
+	_, err := ServerECDH(serverEnd, &KeyAgreementConfig{PeerStatic: clientKey.PublicKey()})
+	if err != ErrPeerAuth {
+		t.Errorf("ServerECDH() error = %v, want %v", err, ErrPeerAuth)
+	}
+	serverEnd.Close()
+	p256Key, _ := ecdh.P256().GenerateKey(rand.Reader)
+	if _, err := ClientECDH(clientEnd, &KeyAgreementConfig{Static: p256Key}); err != errKexCurve {
+		t.Errorf("ClientECDH() with a P-256 key error = %v, want %v", err, errKexCurve)
+	}
+}
+
+func TestHKDF(t *testing.T) {
+	// Test case 1 of RFC 5869.
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	wantPRK := "077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5"
+	wantOKM := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"
+	prk := hkdfExtract(salt, ikm)
+	if got := hex.EncodeToString(prk); got != wantPRK {
+		t.Errorf("hkdfExtract() = %v, want %v", got, wantPRK)
+	}
+	if got := hex.EncodeToString(hkdfExpand(prk, string(info), 42)); got != wantOKM {
+		t.Errorf("hkdfExpand() = %v, want %v", got, wantOKM)
+	}
+}
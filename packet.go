@@ -0,0 +1,255 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the PacketSealer and PacketOpener types, which encrypt and
+// authenticate datagrams that may be lost, duplicated, or delivered out of
+// order.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"math"
+	"sync"
+)
+
+// Each packet is encrypted starting at its own block number, which is sent in
+// the packet so that it can be decrypted without the packets before it:
+//
+//	version    byte     PacketVersion
+//	index      uint64   big-endian block number the data was encrypted at
+//	data       []byte   the encrypted data
+//	tag        [16]byte HMAC-SHA256 over the version, index, and encrypted
+//	                    data, truncated to 16 bytes
+//
+// The tag is keyed by a key derived from the engine, so only a holder of the
+// secret key can create a packet the PacketOpener accepts.
+const (
+	PacketVersion  byte = 1
+	PacketOverhead int  = packetHeaderSize + packetTagSize
+	// PacketReplayWindow is the number of blocks before the highest block
+	// number received for which a PacketOpener remembers which packets have
+	// been opened.  Older packets are rejected.
+	PacketReplayWindow = 4096
+	packetHeaderSize   = 1 + 8
+	packetTagSize      = 16
+)
+
+// The labels added to the shared secret for the packets sent by each side (see
+// NewPacketPair).
+const (
+	clientPackets = "\x00tnt2engine client packets"
+	serverPackets = "\x00tnt2engine server packets"
+)
+
+// Errors returned by a PacketSealer or a PacketOpener.
+var (
+	ErrPacketAuth   = errors.New("tnt2engine: packet failed authentication")
+	ErrPacketReplay = errors.New("tnt2engine: packet was replayed or is too old")
+	errPacketIndex  = errors.New("tnt2engine: the block number does not fit in a packet header")
+)
+
+// packetMAC returns the HMAC used to create the tags of the packets of e sent
+// in the given direction ("" if it is not known).
+func packetMAC(e *Tnt2Engine, direction string) hash.Hash {
+	return hmac.New(sha256.New, e.deriveKey("packet tag"+direction))
+}
+
+// packetTag returns the tag of the packet, which is the header followed by
+// the encrypted data.
+func packetTag(mac hash.Hash, packet []byte) []byte {
+	mac.Reset()
+	mac.Write(packet)
+	return mac.Sum(nil)[:packetTagSize]
+}
+
+// PacketSealer encrypts and authenticates packets.  Each packet is encrypted
+// starting at the block following the previous packet, so no two packets use
+// the same block numbers.  It is safe for concurrent use.
+//
+// A secret key must only be used to seal packets in one direction: if both
+// peers sealed with the same key they would encrypt at the same block
+// numbers, and a packet sent back to its sender would be accepted.  Peers that
+// both send packets should use NewPacketPair, which gives each direction its
+// own key.
+type PacketSealer struct {
+	mu   sync.Mutex
+	e    *Tnt2Engine
+	mac  hash.Hash
+	next uint64 // The block number of the next packet.
+}
+
+// NewPacketSealer returns a PacketSealer that encrypts with a clone of e,
+// starting at e.Index(), which must fit in a uint64.  The block number
+// following the packets sealed so far is returned by Index, and should be
+// saved (e.g. in a CounterStore) so that it is not used again.
+func NewPacketSealer(e *Tnt2Engine) (*PacketSealer, error) {
+	idx := e.Index()
+	if !idx.IsUint64() {
+		return nil, errPacketIndex
+	}
+	return newPacketSealer(e.Clone(), "", idx.Uint64()), nil
+}
+
+// newPacketSealer returns a PacketSealer that encrypts with e, sending packets
+// in the given direction, starting at the block number next.
+func newPacketSealer(e *Tnt2Engine, direction string, next uint64) *PacketSealer {
+	s := new(PacketSealer)
+	s.e = e
+	s.mac = packetMAC(e, direction)
+	s.next = next
+	return s
+}
+
+// Index returns the block number that the next packet will be encrypted at.
+func (s *PacketSealer) Index() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.next
+}
+
+// Seal encrypts plaintext and returns it as a packet, which is PacketOverhead
+// bytes longer than plaintext.  Every packet uses at least one block number,
+// even if plaintext is empty, so that each packet has its own block number.
+func (s *PacketSealer) Seal(plaintext []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blocks := uint64((len(plaintext) + CipherBlockBytes - 1) / CipherBlockBytes)
+	if blocks == 0 {
+		blocks = 1
+	}
+	if s.next > math.MaxUint64-blocks {
+		return nil, errPacketIndex
+	}
+	s.e.SetIndexUint64(s.next)
+	ciphertext, err := runMachine(s.e, "E", plaintext)
+	if err != nil {
+		return nil, err
+	}
+	packet := make([]byte, 0, PacketOverhead+len(ciphertext))
+	packet = append(packet, PacketVersion)
+	packet = binary.BigEndian.AppendUint64(packet, s.next)
+	packet = append(packet, ciphertext...)
+	packet = append(packet, packetTag(s.mac, packet)...)
+	s.next += blocks
+	return packet, nil
+}
+
+// PacketOpener checks and decrypts packets sealed by a PacketSealer using the
+// same secret key.  The packets may be opened in any order, but each packet is
+// only opened once: a packet that was already opened, or whose block number is
+// more than PacketReplayWindow blocks before the highest block number opened,
+// is rejected with ErrPacketReplay.  It is safe for concurrent use.
+type PacketOpener struct {
+	mu     sync.Mutex
+	e      *Tnt2Engine
+	mac    hash.Hash
+	window replayWindow
+}
+
+// NewPacketOpener returns a PacketOpener that decrypts with a clone of e.
+func NewPacketOpener(e *Tnt2Engine) *PacketOpener {
+	return newPacketOpener(e.Clone(), "")
+}
+
+// newPacketOpener returns a PacketOpener that decrypts with e the packets sent
+// in the given direction.
+func newPacketOpener(e *Tnt2Engine, direction string) *PacketOpener {
+	o := new(PacketOpener)
+	o.e = e
+	o.mac = packetMAC(e, direction)
+	return o
+}
+
+// NewPacketPair returns the PacketSealer and PacketOpener of one side of a
+// two-way exchange of packets using the shared secret.  The client (client is
+// true) and the server each seal with an engine created from the secret and
+// the label of their own direction, and open with the engine of the other
+// direction, so the two sides never use the same key stream and a packet sent
+// back to its sender is rejected.  The sealer starts at a random block number
+// below 2^63, so that a new pair created from the same secret is unlikely to
+// reuse the block numbers of an earlier one.
+func NewPacketPair(secret []byte, client bool) (*PacketSealer, *PacketOpener, error) {
+	var start [8]byte
+	if _, err := rand.Read(start[:]); err != nil {
+		return nil, nil, err
+	}
+	out, in := clientPackets, serverPackets
+	if !client {
+		out, in = in, out
+	}
+	sealE, openE := new(Tnt2Engine), new(Tnt2Engine)
+	sealE.Init(append(append([]byte(nil), secret...), out...), "")
+	openE.Init(append(append([]byte(nil), secret...), in...), "")
+	next := binary.BigEndian.Uint64(start[:]) >> 1
+	return newPacketSealer(sealE, out, next), newPacketOpener(openE, in), nil
+}
+
+// Open checks packet and returns its decrypted data.  It returns ErrPacketAuth
+// if the packet was not sealed with the same secret key or has been changed,
+// and ErrPacketReplay if it is a replay.  A packet that is rejected does not
+// change the state of the PacketOpener.
+func (o *PacketOpener) Open(packet []byte) ([]byte, error) {
+	if len(packet) < PacketOverhead || packet[0] != PacketVersion {
+		return nil, ErrPacketAuth
+	}
+	body, tag := packet[:len(packet)-packetTagSize], packet[len(packet)-packetTagSize:]
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !hmac.Equal(tag, packetTag(o.mac, body)) {
+		return nil, ErrPacketAuth
+	}
+	idx := binary.BigEndian.Uint64(body[1:packetHeaderSize])
+	if !o.window.check(idx) {
+		return nil, ErrPacketReplay
+	}
+	o.e.SetIndexUint64(idx)
+	plaintext, err := runMachine(o.e, "D", body[packetHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+	o.window.mark(idx)
+	return plaintext, nil
+}
+
+// replayWindow remembers the block numbers of the packets opened in the last
+// PacketReplayWindow blocks.
+type replayWindow struct {
+	top  uint64 // One more than the highest block number marked, or 0.
+	seen [PacketReplayWindow / 64]uint64
+}
+
+// check returns true if a packet at the block number idx may be opened.
+func (w *replayWindow) check(idx uint64) bool {
+	if idx >= w.top {
+		return true
+	}
+	if w.top-idx > PacketReplayWindow {
+		return false
+	}
+	bit := idx % PacketReplayWindow
+	return w.seen[bit/64]&(1<<(bit%64)) == 0
+}
+
+// mark records that the packet at the block number idx has been opened.  The
+// window slides forward if idx is the highest block number marked so far.
+func (w *replayWindow) mark(idx uint64) {
+	if idx >= w.top {
+		if idx-w.top >= PacketReplayWindow {
+			w.seen = [PacketReplayWindow / 64]uint64{}
+		} else {
+			for i := w.top; i <= idx; i++ {
+				bit := i % PacketReplayWindow
+				w.seen[bit/64] &^= 1 << (bit % 64)
+			}
+		}
+		w.top = idx + 1
+	}
+	bit := idx % PacketReplayWindow
+	w.seen[bit/64] |= 1 << (bit % 64)
+}
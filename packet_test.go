@@ -0,0 +1,192 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPacket(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	tnt2Machine.SetIndex(big.NewInt(100))
+	sealer, err := NewPacketSealer(&tnt2Machine)
+	if err != nil {
+		t.Fatalf("NewPacketSealer() error = %v", err)
+	}
+	opener := NewPacketOpener(&tnt2Machine)
+	rnd := rand.New(rand.NewSource(1))
+	var messages, packets [][]byte
+	for i := 0; i < 20; i++ {
+		message := []byte(fmt.Sprintf("telemetry %d: %x", i, rnd.Int63()))
+		message = append(message, make([]byte, rnd.Intn(3*CipherBlockBytes))...)
+		if i == 7 {
+			message = nil
+		}
+		packet, err := sealer.Seal(message)
+		if err != nil {
+			t.Fatalf("PacketSealer.Seal() error = %v", err)
+		}
+		if len(packet) != len(message)+PacketOverhead {
+			t.Errorf("len(packet) = %d, want %d", len(packet), len(message)+PacketOverhead)
+		}
+		messages = append(messages, message)
+		packets = append(packets, packet)
+	}
+	if got := tnt2Machine.Index(); got.Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("Tnt2Engine.Index() after sealing = %s, want 100", got)
+	}
+	// Send the packets over loopback UDP, out of order and with duplicates,
+	// and drop one of them.
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	order := rnd.Perm(len(packets))
+	order = append(order[1:], order[3], order[5])
+	for _, i := range order {
+		if _, err := client.Write(packets[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opened := make(map[string]bool)
+	replays := 0
+	buf := make([]byte, 2048)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for range order {
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom() error = %v", err)
+		}
+		message, err := opener.Open(buf[:n])
+		switch err {
+		case nil:
+			opened[string(message)] = true
+		case ErrPacketReplay:
+			replays++
+		default:
+			t.Errorf("PacketOpener.Open() error = %v", err)
+		}
+	}
+	if replays != 2 {
+		t.Errorf("PacketOpener.Open() rejected %d replays, want 2", replays)
+	}
+	for _, i := range order[:len(order)-2] {
+		if !opened[string(messages[i])] {
+			t.Errorf("message %d was not opened", i)
+		}
+	}
+	if len(opened) != len(packets)-1 {
+		t.Errorf("%d messages were opened, want %d", len(opened), len(packets)-1)
+	}
+}
+
+func TestPacketOpener_Open(t *testing.T) {
+	var tnt2Machine, other Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	other.Init([]byte("OtherKey"), "")
+	sealer, _ := NewPacketSealer(&tnt2Machine)
+	otherSealer, _ := NewPacketSealer(&other)
+	seal := func(s *PacketSealer, blocks int) []byte {
+		packet, err := s.Seal(make([]byte, blocks*CipherBlockBytes))
+		if err != nil {
+			t.Fatalf("PacketSealer.Seal() error = %v", err)
+		}
+		return packet
+	}
+	first := seal(sealer, 1)
+	tampered := seal(sealer, 1)
+	tampered[packetHeaderSize+3] ^= 1
+	moved := seal(sealer, 1)
+	moved[packetHeaderSize-1]++
+	foreign := seal(otherSealer, 1)
+	latest := seal(sealer, PacketReplayWindow)
+	tests := []struct {
+		name    string
+		packet  []byte
+		wantErr error
+	}{
+		{name: "tpoo1", packet: first[:PacketOverhead-1], wantErr: ErrPacketAuth},
+		{name: "tpoo2", packet: tampered, wantErr: ErrPacketAuth},
+		{name: "tpoo3", packet: moved, wantErr: ErrPacketAuth},
+		{name: "tpoo4", packet: foreign, wantErr: ErrPacketAuth},
+		{name: "tpoo5", packet: latest, wantErr: nil},
+		{name: "tpoo6", packet: latest, wantErr: ErrPacketReplay},
+		{name: "tpoo7", packet: first, wantErr: nil},
+		{name: "tpoo8", packet: seal(sealer, 1), wantErr: nil},
+		{name: "tpoo9", packet: first, wantErr: ErrPacketReplay},
+		{name: "tpoo10", packet: seal(sealer, 1), wantErr: nil},
+		{name: "tpoo11", packet: seal(sealer, 1), wantErr: nil},
+	}
+	opener := NewPacketOpener(&tnt2Machine)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := opener.Open(tt.packet)
+			if err != tt.wantErr {
+				t.Fatalf("PacketOpener.Open() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(got, make([]byte, len(tt.packet)-PacketOverhead)) {
+				t.Errorf("PacketOpener.Open() did not return the sealed data")
+			}
+		})
+	}
+	// Once the window has moved past the first packets, they are too old to
+	// be opened, even if they were never opened before.
+	opener = NewPacketOpener(&tnt2Machine)
+	if _, err := opener.Open(seal(sealer, 1)); err != nil {
+		t.Fatalf("PacketOpener.Open() error = %v", err)
+	}
+	if _, err := opener.Open(moved[:0]); err != ErrPacketAuth {
+		t.Errorf("PacketOpener.Open() of an empty packet error = %v, want %v", err, ErrPacketAuth)
+	}
+	if _, err := opener.Open(latest); err != ErrPacketReplay {
+		t.Errorf("PacketOpener.Open() of an old packet error = %v, want %v", err, ErrPacketReplay)
+	}
+}
+
+func TestNewPacketPair(t *testing.T) {
+	secret := []byte("SharedSecretKey")
+	clientSealer, clientOpener, err := NewPacketPair(secret, true)
+	if err != nil {
+		t.Fatalf("NewPacketPair() error = %v", err)
+	}
+	serverSealer, serverOpener, err := NewPacketPair(secret, false)
+	if err != nil {
+		t.Fatalf("NewPacketPair() error = %v", err)
+	}
+	msg := []byte("the same message in both directions")
+	toServer, err := clientSealer.Seal(msg)
+	if err != nil {
+		t.Fatalf("PacketSealer.Seal() error = %v", err)
+	}
+	toClient, err := serverSealer.Seal(msg)
+	if err != nil {
+		t.Fatalf("PacketSealer.Seal() error = %v", err)
+	}
+	if got, err := serverOpener.Open(toServer); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("the server opened %q, %v, want %q", got, err, msg)
+	}
+	if got, err := clientOpener.Open(toClient); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("the client opened %q, %v, want %q", got, err, msg)
+	}
+	// A packet sent back to its sender is rejected.
+	if _, err := clientOpener.Open(toServer); err != ErrPacketAuth {
+		t.Errorf("the client opened its own packet, error = %v, want %v", err, ErrPacketAuth)
+	}
+	if _, err := serverOpener.Open(toClient); err != ErrPacketAuth {
+		t.Errorf("the server opened its own packet, error = %v, want %v", err, ErrPacketAuth)
+	}
+}
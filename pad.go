@@ -0,0 +1,114 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the padding policies used to hide the length of a message.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+var errPadRandom = errors.New("tnt2engine: invalid range of random padding")
+
+// PadPolicy chooses the size a message is padded to, so that the length of the
+// ciphertext only shows which bucket the length of the message falls in.
+type PadPolicy interface {
+	// PaddedSize returns the size, not less than n, that a message of n
+	// bytes is padded to.
+	PaddedSize(n int64) int64
+}
+
+// EnginePadPolicy is a PadPolicy that chooses the padded size using the engine
+// encrypting the message.  A StreamWriter calls PaddedSizeFor, instead of
+// PaddedSize, for a policy that implements it, so a policy that wraps one must
+// also implement it to keep using the engine.
+type EnginePadPolicy interface {
+	PadPolicy
+	// PaddedSizeFor returns the size, not less than n, that a message of n
+	// bytes encrypted by e, in the stream with the given (encoded) header,
+	// is padded to.
+	PaddedSizeFor(e *Tnt2Engine, header []byte, n int64) int64
+}
+
+type padMultiple int64
+
+func (m padMultiple) PaddedSize(n int64) int64 {
+	if n == 0 {
+		return int64(m)
+	}
+	return (n + int64(m) - 1) / int64(m) * int64(m)
+}
+
+// PadMultiple returns a PadPolicy that pads a message to the smallest positive
+// multiple of m bytes.  It panics if m <= 0.
+func PadMultiple(m int) PadPolicy {
+	if m <= 0 {
+		panic("invalid argument to PadMultiple")
+	}
+	return padMultiple(m)
+}
+
+type padPowerOfTwo struct{}
+
+func (padPowerOfTwo) PaddedSize(n int64) int64 {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len64(uint64(n-1))
+}
+
+// PadPowerOfTwo returns a PadPolicy that pads a message to the next power of
+// two bytes.
+func PadPowerOfTwo() PadPolicy {
+	return padPowerOfTwo{}
+}
+
+// padMinimum pads a message to at least the given size.
+type padMinimum int64
+
+func (m padMinimum) PaddedSize(n int64) int64 {
+	if n < int64(m) {
+		return int64(m)
+	}
+	return n
+}
+
+type padRandom struct {
+	min, max int64
+}
+
+// PaddedSize adds the most padding, max bytes, since there is no engine to
+// draw the amount from.
+func (p padRandom) PaddedSize(n int64) int64 {
+	return n + p.max
+}
+
+// PaddedSizeFor adds an amount drawn from an HMAC keyed by a key derived from
+// e, so it can not be predicted without the secret key, and is different for
+// each stream.
+func (p padRandom) PaddedSizeFor(e *Tnt2Engine, header []byte, n int64) int64 {
+	mac := hmac.New(sha256.New, e.deriveKey("stream random padding"))
+	mac.Write(header)
+	binary.Write(mac, binary.BigEndian, n)
+	return p.padded(n, binary.BigEndian.Uint64(mac.Sum(nil)))
+}
+
+// padded returns n plus an amount between min and max chosen by r.
+func (p padRandom) padded(n int64, r uint64) int64 {
+	return n + p.min + int64(r%uint64(p.max-p.min+1))
+}
+
+// PadRandom returns an EnginePadPolicy that adds between min and max bytes
+// (inclusive) to a message, the amount being drawn from the engine encrypting
+// the stream.  It returns an error if min < 0 or max < min.
+func PadRandom(min, max int) (EnginePadPolicy, error) {
+	if min < 0 || max < min {
+		return nil, errPadRandom
+	}
+	return padRandom{int64(min), int64(max)}, nil
+}
@@ -0,0 +1,67 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestPadPolicy_PaddedSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy PadPolicy
+		n      int64
+		want   int64
+	}{
+		{name: "tpps1", policy: PadMultiple(100), n: 0, want: 100},
+		{name: "tpps2", policy: PadMultiple(100), n: 1, want: 100},
+		{name: "tpps3", policy: PadMultiple(100), n: 100, want: 100},
+		{name: "tpps4", policy: PadMultiple(100), n: 101, want: 200},
+		{name: "tpps5", policy: PadPowerOfTwo(), n: 0, want: 1},
+		{name: "tpps6", policy: PadPowerOfTwo(), n: 1, want: 1},
+		{name: "tpps7", policy: PadPowerOfTwo(), n: 3, want: 4},
+		{name: "tpps8", policy: PadPowerOfTwo(), n: 4096, want: 4096},
+		{name: "tpps9", policy: PadPowerOfTwo(), n: 4097, want: 8192},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.PaddedSize(tt.n); got != tt.want {
+				t.Errorf("PaddedSize(%d) = %d, want %d", tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPadRandom(t *testing.T) {
+	tntMachine := new(Tnt2Engine)
+	tntMachine.Init([]byte("SecretKey"), "")
+	policy, err := PadRandom(10, 20)
+	if err != nil {
+		t.Fatalf("PadRandom() error = %v", err)
+	}
+	header := (&StreamHeader{Version: StreamVersion, ChunkSize: 64, Start: big.NewInt(0)}).marshal()
+	seen := make(map[int64]bool)
+	for i := int64(0); i < 1000; i++ {
+		got := policy.PaddedSizeFor(tntMachine, header, 1000+i) - 1000 - i
+		if got < 10 || got > 20 {
+			t.Fatalf("PadRandom(10, 20) added %d bytes", got)
+		}
+		seen[got] = true
+		if again := policy.PaddedSizeFor(tntMachine, header, 1000+i) - 1000 - i; again != got {
+			t.Fatalf("PaddedSizeFor() added %d bytes, then %d bytes", got, again)
+		}
+	}
+	if len(seen) != 11 {
+		t.Errorf("PadRandom(10, 20) added %d different amounts, want 11", len(seen))
+	}
+	if got := policy.PaddedSize(1000); got != 1020 {
+		t.Errorf("PadRandom(10, 20).PaddedSize(1000) = %d, want 1020", got)
+	}
+	for _, args := range [][2]int{{-1, 5}, {5, 4}} {
+		if _, err := PadRandom(args[0], args[1]); err != errPadRandom {
+			t.Errorf("PadRandom(%d, %d) error = %v, want %v", args[0], args[1], err, errPadRandom)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the period analysis of the tnt2engine.
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// PeriodAnalysis describes the exact period of a Tnt2Engine.  MaximalStates()
+// is the product of the rotor sizes and the permutator MaximalStates, which is
+// only the true period when all of those values are relatively prime to each
+// other.  The exact period is the least common multiple of the crypter periods.
+type PeriodAnalysis struct {
+	Period         *big.Int   // The number of blocks before the engine repeats.
+	CrypterPeriods []*big.Int // The period of each crypter, in the order given by Engine().
+	Warnings       []string   // Descriptions of any factors shared between periods.
+}
+
+// PeriodAnalysis calculates the exact period of the engine as the least common
+// multiple of the periods of its rotors and permutators.  Crypters that do not
+// affect the data (such as the Counter) have a period of 1.  A warning is
+// generated for each pair of crypters whose periods share a common factor and
+// for each permutator whose cycle lengths share a common factor, since these
+// reduce the period below the value returned by MaximalStates().
+func (e *Tnt2Engine) PeriodAnalysis() *PeriodAnalysis {
+	pa := new(PeriodAnalysis)
+	pa.Period = new(big.Int).Set(BigOne)
+	pa.CrypterPeriods = make([]*big.Int, len(e.engine))
+	for idx, machine := range e.engine {
+		period := BigOne
+		switch v := machine.(type) {
+		case *Rotor:
+			period = big.NewInt(int64(v.Period()))
+		case *Permutator:
+			period = big.NewInt(int64(v.Period()))
+			if period.Cmp(big.NewInt(int64(v.MaximalStates))) != 0 {
+				pa.Warnings = append(pa.Warnings,
+					fmt.Sprintf("%s: cycle lengths %v are not relatively prime (period %s, MaximalStates %d)",
+						crypterName(idx, machine), cycleLengths(v), period, v.MaximalStates))
+			}
+		}
+		pa.CrypterPeriods[idx] = new(big.Int).Set(period)
+		pa.Period = lcm(pa.Period, period)
+	}
+	gcd := new(big.Int)
+	for i := 0; i < len(e.engine); i++ {
+		for j := i + 1; j < len(e.engine); j++ {
+			gcd.GCD(nil, nil, pa.CrypterPeriods[i], pa.CrypterPeriods[j])
+			if gcd.Cmp(BigOne) > 0 {
+				pa.Warnings = append(pa.Warnings,
+					fmt.Sprintf("%s (period %s) and %s (period %s) share the factor %s",
+						crypterName(i, e.engine[i]), pa.CrypterPeriods[i],
+						crypterName(j, e.engine[j]), pa.CrypterPeriods[j], gcd))
+			}
+		}
+	}
+	if e.maximalStates != nil && pa.Period.Cmp(e.maximalStates) != 0 {
+		pa.Warnings = append(pa.Warnings,
+			fmt.Sprintf("the period (%s) is less than MaximalStates (%s)", pa.Period, e.maximalStates))
+	}
+	return pa
+}
+
+// crypterName returns a short description of the crypter at position idx in
+// the engine for use in warnings.
+func crypterName(idx int, machine Crypter) string {
+	switch machine.(type) {
+	case *Rotor:
+		return fmt.Sprintf("rotor %d", idx)
+	case *Permutator:
+		return fmt.Sprintf("permutator %d", idx)
+	case *Counter:
+		return fmt.Sprintf("counter %d", idx)
+	default:
+		return fmt.Sprintf("crypter %d", idx)
+	}
+}
+
+// cycleLengths returns the lengths of the permutator cycles.
+func cycleLengths(p *Permutator) []int {
+	lengths := make([]int, len(p.Cycles))
+	for i, v := range p.Cycles {
+		lengths[i] = v.Length
+	}
+	return lengths
+}
+
+// lcm returns the least common multiple of a and b as a new big.Int.
+func lcm(a, b *big.Int) *big.Int {
+	if a.Sign() == 0 || b.Sign() == 0 {
+		return new(big.Int)
+	}
+	gcd := new(big.Int).GCD(nil, nil, a, b)
+	res := new(big.Int).Div(a, gcd)
+	return res.Mul(res, b)
+}
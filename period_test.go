@@ -0,0 +1,129 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// newReducedEngine creates a small engine whose period is small enough to be
+// found by brute force.  The rotor periods (3 and 6) share the factor 3 and
+// the permutator cycle lengths (2, 4, 125, 125) are not relatively prime.
+func newReducedEngine() *Tnt2Engine {
+	rnd := rand.New(rand.NewSource(1))
+	rotorData := func(size int) []byte {
+		rotor := make([]byte, (size+CipherBlockSize+7)/8)
+		rnd.Read(rotor)
+		return rotor
+	}
+	randp := make([]byte, CipherBlockSize)
+	for i, v := range rnd.Perm(CipherBlockSize) {
+		randp[i] = byte(v)
+	}
+	cntr := new(Counter)
+	cntr.SetIndex(BigZero)
+	e := new(Tnt2Engine)
+	e.engine = []Crypter{
+		new(Rotor).New(9, 4, 3, rotorData(9)),
+		new(Permutator).New([]int{2, 4, 125, 125}, randp),
+		new(Rotor).New(6, 1, 1, rotorData(6)),
+		cntr,
+	}
+	return e
+}
+
+// engineState captures the state of the rotors and permutators in e.
+func engineState(e *Tnt2Engine) []int {
+	var state []int
+	for _, machine := range e.engine {
+		switch v := machine.(type) {
+		case *Rotor:
+			state = append(state, v.Current)
+		case *Permutator:
+			for _, cycle := range v.Cycles {
+				state = append(state, cycle.Current)
+			}
+		}
+	}
+	return state
+}
+
+// encryptBlock passes blk through the crypters of e in order.
+func encryptBlock(e *Tnt2Engine, blk CipherBlock) CipherBlock {
+	for _, machine := range e.engine {
+		blk = machine.ApplyF(blk)
+	}
+	return blk
+}
+
+func TestTnt2Engine_PeriodAnalysis(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	// Both permutators use the same CycleSizes, so the period of the default
+	// engine is MaximalStates() divided by the period of one permutator.
+	want := new(big.Int).Div(tnt2Machine.MaximalStates(), big.NewInt(16736265))
+	tests := []struct {
+		name             string
+		e                *Tnt2Engine
+		want             *big.Int
+		wantPeriods      []*big.Int
+		wantWarningCount int
+	}{
+		{
+			name:             "ttepa1",
+			e:                &tnt2Machine,
+			want:             want,
+			wantWarningCount: 2,
+		},
+		{
+			name: "ttepa2",
+			e:    newReducedEngine(),
+			want: big.NewInt(1500),
+			wantPeriods: []*big.Int{
+				big.NewInt(3), big.NewInt(500), big.NewInt(6), big.NewInt(1)},
+			// The permutator cycles, the two rotors (factor 3), and the
+			// permutator and second rotor (factor 2).
+			wantWarningCount: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.e.PeriodAnalysis()
+			if got.Period.Cmp(tt.want) != 0 {
+				t.Errorf("PeriodAnalysis().Period = %s, want %s", got.Period, tt.want)
+			}
+			if tt.wantPeriods != nil && !reflect.DeepEqual(got.CrypterPeriods, tt.wantPeriods) {
+				t.Errorf("PeriodAnalysis().CrypterPeriods = %v, want %v", got.CrypterPeriods, tt.wantPeriods)
+			}
+			if len(got.Warnings) != tt.wantWarningCount {
+				t.Errorf("len(PeriodAnalysis().Warnings) = %d, want %d: %q", len(got.Warnings), tt.wantWarningCount, got.Warnings)
+			}
+		})
+	}
+}
+
+func TestTnt2Engine_PeriodBruteForce(t *testing.T) {
+	e := newReducedEngine()
+	period := int(e.PeriodAnalysis().Period.Int64())
+	initial := engineState(e)
+	outputs := make([]CipherBlock, 2*period)
+	for i := range outputs {
+		outputs[i] = encryptBlock(e, make(CipherBlock, CipherBlockBytes))
+		state := engineState(e)
+		if reflect.DeepEqual(state, initial) && i+1 != period && i+1 != 2*period {
+			t.Fatalf("engine state repeated after %d blocks, want %d", i+1, period)
+		}
+	}
+	if !reflect.DeepEqual(engineState(e), initial) {
+		t.Errorf("engine state did not repeat after %d blocks", 2*period)
+	}
+	for i := 0; i < period; i++ {
+		if !reflect.DeepEqual(outputs[i], outputs[i+period]) {
+			t.Fatalf("output block %d != output block %d", i, i+period)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the lookup tables used by the permutator to permute a block.
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sync/atomic"
+)
+
+// block256 holds a 256 bit block as four little-endian 64 bit words.  Bit i
+// of the block is bit (i & 63) of word (i >> 6), which is the same bit that
+// GetBit(blk, i) returns for the block stored as bytes.
+type block256 [4]uint64
+
+// loadBlock256 converts the first 32 bytes of blk into a block256.
+func loadBlock256(blk []byte) (b block256) {
+	b[0] = binary.LittleEndian.Uint64(blk[0:])
+	b[1] = binary.LittleEndian.Uint64(blk[8:])
+	b[2] = binary.LittleEndian.Uint64(blk[16:])
+	b[3] = binary.LittleEndian.Uint64(blk[24:])
+	return
+}
+
+// store writes the block256 into the first 32 bytes of blk.
+func (b *block256) store(blk []byte) {
+	binary.LittleEndian.PutUint64(blk[0:], b[0])
+	binary.LittleEndian.PutUint64(blk[8:], b[1])
+	binary.LittleEndian.PutUint64(blk[16:], b[2])
+	binary.LittleEndian.PutUint64(blk[24:], b[3])
+}
+
+// shl returns b shifted left (towards the higher numbered bits) by n bits.
+func (b block256) shl(n uint) (res block256) {
+	w, s := int(n>>6), n&63
+	for i := 3; i >= w; i-- {
+		res[i] = b[i-w] << s
+		if i-w > 0 {
+			res[i] |= b[i-w-1] >> (64 - s)
+		}
+	}
+	return
+}
+
+// shr returns b shifted right (towards the lower numbered bits) by n bits.
+func (b block256) shr(n uint) (res block256) {
+	w, s := int(n>>6), n&63
+	for i := 0; i+w < 4; i++ {
+		res[i] = b[i+w] >> s
+		if i+w < 3 {
+			res[i] |= b[i+w+1] << (64 - s)
+		}
+	}
+	return
+}
+
+// bitTable is a bit permutation compiled into one table for each of the 32
+// byte positions in a block.  Entry [i][v] holds the output bits that are set
+// by byte value v at byte position i, so a block is permuted with 32 table
+// lookups and ORs instead of 256 GetBit/SetBit calls.
+type bitTable [CipherBlockBytes][256]block256
+
+// newBitTable compiles the bit permutation that moves input bit i to output
+// bit dest[i] into a bitTable.
+func newBitTable(dest *[CipherBlockSize]byte) *bitTable {
+	t := new(bitTable)
+	for pos := range t {
+		var single [BitsPerByte]block256
+		for bit := range single {
+			v := dest[pos*BitsPerByte+bit]
+			single[bit][v>>6] = 1 << (v & 63)
+		}
+		// Each entry is the entry for the value with its lowest set bit
+		// cleared, plus the output bit for that lowest set bit.
+		for v := 1; v < 256; v++ {
+			bit := bits.TrailingZeros8(uint8(v))
+			prev := &t[pos][v&(v-1)]
+			t[pos][v] = block256{
+				prev[0] | single[bit][0], prev[1] | single[bit][1],
+				prev[2] | single[bit][2], prev[3] | single[bit][3]}
+		}
+	}
+	return t
+}
+
+// permute applies the bit permutation in t to b.
+func (t *bitTable) permute(b block256) block256 {
+	var r0, r1, r2, r3 uint64
+	for w, word := range b {
+		tbl := (*[8][256]block256)(t[w*8:])
+		for i := range tbl {
+			e := &tbl[i][byte(word)]
+			r0 |= e[0]
+			r1 |= e[1]
+			r2 |= e[2]
+			r3 |= e[3]
+			word >>= 8
+		}
+	}
+	return block256{r0, r1, r2, r3}
+}
+
+// permTables holds the bit permutation of a Permutator, in one direction,
+// split into the parts that do not depend on the current state of the
+// Permutator.  Since bitPerm[Randp[k]] is Randp[Randp[k']] where k' is k
+// rotated by Current within its cycle, permuting a block is done by:
+//  1. gather - moving bit Randp[k] to bit k, which places the bits of each
+//     cycle in a contiguous run starting at Cycle.Start,
+//  2. rotating the bits of each cycle by Cycle.Current, and
+//  3. scatter - moving bit k to bit Randp[Randp[k]].
+//
+// The inverse permutation reverses these steps.  This means that the tables
+// only need to be rebuilt when Randp changes, not each time the state of the
+// Permutator changes.
+type permTables struct {
+	gather  *bitTable
+	scatter *bitTable
+	masks   []block256   // The bits of each cycle (in gathered order).
+	users   atomic.Int32 // The number of permutators using the tables.
+}
+
+// newPermTables builds the forward (encryption) tables for p, or the inverse
+// (decryption) tables if inverse is true.
+func newPermTables(p *Permutator, inverse bool) *permTables {
+	var gather, scatter [CipherBlockSize]byte
+	for k, v := range p.Randp {
+		rr := p.Randp[v]
+		if inverse {
+			gather[rr] = byte(k)
+			scatter[k] = v
+		} else {
+			gather[v] = byte(k)
+			scatter[k] = rr
+		}
+	}
+	pt := new(permTables)
+	pt.gather = newBitTable(&gather)
+	pt.scatter = newBitTable(&scatter)
+	pt.masks = make([]block256, len(p.Cycles))
+	for i, c := range p.Cycles {
+		for bit := c.Start; bit < c.Start+c.Length; bit++ {
+			pt.masks[i][bit>>6] |= 1 << (bit & 63)
+		}
+	}
+	pt.users.Store(1)
+	return pt
+}
+
+// share records that another permutator (a clone) uses the tables.
+func (pt *permTables) share() {
+	if pt != nil {
+		pt.users.Add(1)
+	}
+}
+
+// release records that a permutator no longer uses the tables, and overwrites
+// them once no permutator does.
+func (pt *permTables) release() {
+	if pt == nil || pt.users.Add(-1) != 0 {
+		return
+	}
+	*pt.gather = bitTable{}
+	*pt.scatter = bitTable{}
+	for i := range pt.masks {
+		pt.masks[i] = block256{}
+	}
+}
+
+// rotate rotates the bits of each cycle in b by the Current value of the
+// cycle.  The bits are rotated towards the higher numbered bits for the
+// forward permutation and towards the lower numbered bits for the inverse.
+func (pt *permTables) rotate(b block256, cycles []Cycle, inverse bool) (res block256) {
+	for i, c := range cycles {
+		m := pt.masks[i]
+		seg := block256{b[0] & m[0], b[1] & m[1], b[2] & m[2], b[3] & m[3]}
+		l, r := uint(c.Current), uint(c.Length-c.Current)
+		if inverse {
+			l, r = r, l
+		}
+		hi, lo := seg.shl(l), seg.shr(r)
+		res[0] |= (hi[0] | lo[0]) & m[0]
+		res[1] |= (hi[1] | lo[1]) & m[1]
+		res[2] |= (hi[2] | lo[2]) & m[2]
+		res[3] |= (hi[3] | lo[3]) & m[3]
+	}
+	return
+}
+
+// apply permutes the 32 byte block src into dst (which may be the same
+// slice) using the tables and the current state of the cycles.
+func (pt *permTables) apply(dst, src []byte, cycles []Cycle, inverse bool) {
+	b := pt.scatter.permute(pt.rotate(pt.gather.permute(loadBlock256(src)), cycles, inverse))
+	b.store(dst)
+}
@@ -0,0 +1,65 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+// toBig converts a block256 to a big.Int for comparison.
+func toBig(b block256) *big.Int {
+	blk := make([]byte, CipherBlockBytes)
+	b.store(blk)
+	// big.Int.SetBytes expects big-endian bytes.
+	for i, j := 0, len(blk)-1; i < j; i, j = i+1, j-1 {
+		blk[i], blk[j] = blk[j], blk[i]
+	}
+	return new(big.Int).SetBytes(blk)
+}
+
+func TestBlock256_shifts(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	blk := make([]byte, CipherBlockBytes)
+	rnd.Read(blk)
+	b := loadBlock256(blk)
+	mask := new(big.Int).Sub(new(big.Int).Lsh(BigOne, uint(CipherBlockSize)), BigOne)
+	for n := uint(0); n <= uint(CipherBlockSize); n++ {
+		want := new(big.Int).Lsh(toBig(b), n)
+		want.And(want, mask)
+		if got := toBig(b.shl(n)); got.Cmp(want) != 0 {
+			t.Errorf("block256.shl(%d) = %x, want %x", n, got, want)
+		}
+		want = new(big.Int).Rsh(toBig(b), n)
+		if got := toBig(b.shr(n)); got.Cmp(want) != 0 {
+			t.Errorf("block256.shr(%d) = %x, want %x", n, got, want)
+		}
+	}
+}
+
+func TestBitTable_permute(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	var dest [CipherBlockSize]byte
+	for i, v := range rnd.Perm(CipherBlockSize) {
+		dest[i] = byte(v)
+	}
+	tbl := newBitTable(&dest)
+	blk := make([]byte, CipherBlockBytes)
+	for i := 0; i < 100; i++ {
+		rnd.Read(blk)
+		want := make([]byte, CipherBlockBytes)
+		for bit, v := range dest {
+			if GetBit(blk, uint(bit)) {
+				SetBit(want, uint(v))
+			}
+		}
+		b := tbl.permute(loadBlock256(blk))
+		got := make([]byte, CipherBlockBytes)
+		b.store(got)
+		if string(got) != string(want) {
+			t.Fatalf("bitTable.permute() = %v, want %v", got, want)
+		}
+	}
+}
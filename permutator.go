@@ -8,7 +8,6 @@ import (
 	"bytes"
 	"fmt"
 	"math/big"
-	"sync"
 )
 
 const (
@@ -35,12 +34,23 @@ type Cycle struct {
 }
 
 // Permutator is a type that defines a permutation cryptor in TNT2.
+//
+// The permutation is applied using lookup tables built from Randp and the
+// Start and Length of the Cycles (see permTables).  The forward and inverse
+// tables take about 1 MiB for each permutator, and are shared by the clones of
+// an engine (see Tnt2Engine.Clone) until they are rebuilt.  They are
+// overwritten once no permutator uses them (see Tnt2Engine.Wipe).  The tables
+// are built by New and Update, or before the first block is permuted if the
+// permutator was created some other way (e.g. decoded from JSON).  Randp and
+// the Start and Length of the Cycles must not be changed directly once the
+// tables are built: use New or Update to change the permutation.
 type Permutator struct {
-	CurrentState  int                   // Current number of cycles for this permutator.
-	MaximalStates int                   // Maximum number of cycles this permutator can have before repeating.
-	Cycles        []Cycle               // Cycles ordered by the current permutation.
-	Randp         []byte                // Values 0 - 255 in a random order.
-	bitPerm       [CipherBlockSize]byte // Permutation table created from Randp.
+	CurrentState  int         // Current number of cycles for this permutator.
+	MaximalStates int         // Maximum number of cycles this permutator can have before repeating.
+	Cycles        []Cycle     // Cycles ordered by the current permutation.
+	Randp         []byte      // Values 0 - 255 in a random order.
+	fwdTables     *permTables // Lookup tables for ApplyF built from Randp.
+	invTables     *permTables // Lookup tables for ApplyG built from Randp.
 }
 
 // New creates a permutator and initializes it
@@ -62,7 +72,7 @@ func (p *Permutator) New(cycleSizes []int, randp []byte) *Permutator {
 		// Calculate the maximum number of states the permutator can take.
 		p.MaximalStates *= p.Cycles[i].Length
 	}
-	p.cycle()
+	p.buildTables()
 	return p
 }
 
@@ -73,19 +83,22 @@ func (p *Permutator) Update(random *Rand) {
 	// updated permutators start with a current state of 0
 	p.CurrentState = 0
 	p.MaximalStates = 1
-	// Create a table of byte values [0...255] in a random order
-	if len(p.Randp) == 0 {
-		p.Randp = make([]byte, CipherBlockSize)
-	}
-	for i, val := range random.Perm(CipherBlockSize) {
-		p.Randp[i] = byte(val)
-	}
-	// Chose a size of the cycles to use and randomize order of the values
+	// Create a table of byte values [0...255] in a random order, and chose a
+	// size of the cycles to use and randomize order of the values.  Randp is
+	// not changed until all of the random data is generated, since random
+	// may be using this permutator.
+	randp := random.Perm(CipherBlockSize)
 	cycles := make([]int, NumberPermutationCycles)
 	randi := random.Perm(NumberPermutationCycles)
 	for idx, val := range randi {
 		cycles[idx] = CycleSizes[val]
 	}
+	if len(p.Randp) == 0 {
+		p.Randp = make([]byte, CipherBlockSize)
+	}
+	for i, val := range randp {
+		p.Randp[i] = byte(val)
+	}
 	// update p.Cycles based on the new cycle sizes
 	if len(p.Cycles) == 0 {
 		p.Cycles = make([]Cycle, NumberPermutationCycles)
@@ -101,49 +114,112 @@ func (p *Permutator) Update(random *Rand) {
 		}
 		p.MaximalStates *= p.Cycles[i].Length
 	}
-	p.cycle()
+	p.buildTables()
+}
+
+// buildTables (re)builds the lookup tables used by ApplyF and ApplyG.  This
+// must be done whenever Randp or the cycle lengths change.
+func (p *Permutator) buildTables() {
+	p.releaseTables()
+	p.fwdTables = newPermTables(p, false)
+	p.invTables = newPermTables(p, true)
+}
+
+// releaseTables drops the lookup tables of the permutator, which are
+// overwritten if no clone of the permutator still uses them.
+func (p *Permutator) releaseTables() {
+	p.fwdTables.release()
+	p.invTables.release()
+	p.fwdTables, p.invTables = nil, nil
+}
+
+// checkTables builds the lookup tables if they have not been built.
+func (p *Permutator) checkTables() {
+	if p.fwdTables == nil || p.invTables == nil {
+		p.buildTables()
+	}
 }
 
-// Cycle bitPerm to it's next state.
+// Cycle the permutator to it's next state.  There is no need to rebuild
+// the lookup tables since they do not depend on the current state.
 func (p *Permutator) nextState() {
-	for idx := 0; idx < len(p.Cycles); idx++ {
-		p.Cycles[idx].Current = (p.Cycles[idx].Current + 1) % p.Cycles[idx].Length
-	}
-	p.CurrentState = (p.CurrentState + 1) % p.MaximalStates
-	p.cycle()
-}
-
-// cycle will create a new bitPerm from Randp based on the current cycle.
-func (p *Permutator) cycle() {
-	var wg sync.WaitGroup
-	for cycleIdx := range p.Cycles {
-		wg.Add(1)
-		go func(cIdx int) {
-			defer wg.Done()
-			curCycle := p.Cycles[cIdx]
-			cycle := p.Randp[curCycle.Start : curCycle.Start+curCycle.Length]
-			sIdx := curCycle.Current
-			length := curCycle.Length
-			for _, val := range cycle {
-				p.bitPerm[val] = p.Randp[cycle[sIdx]]
-				sIdx = (sIdx + 1) % length
+	for idx := range p.Cycles {
+		if p.Cycles[idx].Current++; p.Cycles[idx].Current == p.Cycles[idx].Length {
+			p.Cycles[idx].Current = 0
+		}
+	}
+	if p.CurrentState++; p.CurrentState == p.MaximalStates {
+		p.CurrentState = 0
+	}
+}
+
+// bitPerm returns the permutation table created from Randp based on the
+// current cycle.  Bit i of a block is moved to bit bitPerm[i] by ApplyF.
+// The permutation is applied using the lookup tables (see permTables), so
+// this is only needed to inspect the current permutation.
+func (p *Permutator) bitPerm() (bitPerm [CipherBlockSize]byte) {
+	for _, curCycle := range p.Cycles {
+		cycle := p.Randp[curCycle.Start : curCycle.Start+curCycle.Length]
+		sIdx := curCycle.Current
+		for _, val := range cycle {
+			bitPerm[val] = p.Randp[cycle[sIdx]]
+			sIdx++
+			if sIdx == curCycle.Length {
+				sIdx = 0
 			}
-		}(cycleIdx)
+		}
 	}
-	wg.Wait()
+	return
 }
 
 // SetIndex - set the Permutator to the state it would be in after encoding 'idx - 1' blocks
 // of data.
 func (p *Permutator) SetIndex(idx *big.Int) {
+	if idx.IsUint64() {
+		p.SetIndexUint64(idx.Uint64())
+		return
+	}
 	q := new(big.Int)
 	r := new(big.Int)
 	_, r = q.DivMod(idx, big.NewInt(int64(p.MaximalStates)), r)
-	p.CurrentState = int(r.Int64())
+	p.setState(int(r.Int64()))
+}
+
+// SetIndexUint64 is SetIndex for an index that fits in a uint64.  It uses
+// native arithmetic instead of big.Int arithmetic.
+func (p *Permutator) SetIndexUint64(idx uint64) {
+	p.setState(int(idx % uint64(p.MaximalStates)))
+}
+
+// Skip advances the permutator by n states, as if n full blocks had been
+// processed.
+func (p *Permutator) Skip(n uint64) {
+	max := uint64(p.MaximalStates)
+	p.setState(int((uint64(p.CurrentState) + n%max) % max))
+}
+
+// setState sets the current state of the permutator and its cycles.
+func (p *Permutator) setState(state int) {
+	p.CurrentState = state
 	for i := 0; i < NumberPermutationCycles; i++ {
 		p.Cycles[i].Current = p.CurrentState % p.Cycles[i].Length
 	}
-	p.cycle()
+}
+
+// Period returns the number of full blocks the permutator processes before
+// bitPerm repeats.  This is the least common multiple of the cycle lengths,
+// which is only equal to MaximalStates when the cycle lengths are relatively
+// prime to each other.
+func (p *Permutator) Period() int {
+	period := 1
+	for _, cycle := range p.Cycles {
+		a, b := period, cycle.Length
+		for b != 0 {
+			a, b = b, a%b
+		}
+		period = period / a * cycle.Length
+	}
+	return period
 }
 
 // Index returns the current index of the cryptor.  For permutators, this
@@ -159,12 +235,7 @@ func (p *Permutator) Index() *big.Int {
 func (p *Permutator) ApplyF(blk CipherBlock) CipherBlock {
 	if len(blk) == CipherBlockBytes {
 		ress := make([]byte, CipherBlockBytes)
-		for i, v := range p.bitPerm {
-			if GetBit(blk, uint(i)) {
-				SetBit(ress, uint(v))
-			}
-		}
-		p.nextState()
+		p.ApplyFTo(ress, blk)
 		blk = ress
 	}
 	return blk
@@ -177,17 +248,36 @@ func (p *Permutator) ApplyF(blk CipherBlock) CipherBlock {
 func (p *Permutator) ApplyG(blk CipherBlock) CipherBlock {
 	if len(blk) == CipherBlockBytes {
 		ress := make([]byte, CipherBlockBytes)
-		for i, v := range p.bitPerm {
-			if GetBit(blk, uint(v)) {
-				SetBit(ress, uint(i))
-			}
-		}
-		p.nextState()
+		p.ApplyGTo(ress, blk)
 		blk = ress
 	}
 	return blk
 }
 
+// ApplyFTo performs the forward permutation of src into dst.  As with ApplyF,
+// a short block is copied to dst without being permuted.
+func (p *Permutator) ApplyFTo(dst, src CipherBlock) {
+	if len(src) != CipherBlockBytes {
+		copy(dst, src)
+		return
+	}
+	p.checkTables()
+	p.fwdTables.apply(dst, src, p.Cycles, false)
+	p.nextState()
+}
+
+// ApplyGTo performs the reverse permutation of src into dst.  As with ApplyG,
+// a short block is copied to dst without being permuted.
+func (p *Permutator) ApplyGTo(dst, src CipherBlock) {
+	if len(src) != CipherBlockBytes {
+		copy(dst, src)
+		return
+	}
+	p.checkTables()
+	p.invTables.apply(dst, src, p.Cycles, true)
+	p.nextState()
+}
+
 // String formats a string representing the permutator (as Go source code).
 func (p *Permutator) String() string {
 	var output bytes.Buffer
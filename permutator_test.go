@@ -4,8 +4,11 @@
 package tnt2engine
 
 import (
+	"encoding/json"
 	"math/big"
+	"math/rand"
 	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -82,7 +85,7 @@ func TestPermutator_Update(t *testing.T) {
 }
 
 func TestPermutator_nextState(t *testing.T) {
-	// This tests both Permutator.nextState() and Permutator.cycle()
+	// This tests both Permutator.nextState() and Permutator.bitPerm()
 	tests := []struct {
 		name string
 		want [256]byte
@@ -116,8 +119,8 @@ func TestPermutator_nextState(t *testing.T) {
 			}
 			p := new(Permutator).New(cycles, append([]byte(nil), proFormPermutators[0].Randp...))
 			p.nextState()
-			if p.bitPerm != tt.want {
-				t.Errorf("p.bitPerm = %v, want %v", p.bitPerm, tt.want)
+			if got := p.bitPerm(); got != tt.want {
+				t.Errorf("p.bitPerm() = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -164,13 +167,51 @@ func TestPermutator_SetIndex(t *testing.T) {
 			}
 			p := new(Permutator).New(cycles, append([]byte(nil), proFormPermutators[0].Randp...))
 			p.SetIndex(tt.args.idx)
-			if p.bitPerm != tt.want {
-				t.Errorf("p.bitPerm = %v, want %v", p.bitPerm, tt.want)
+			if got := p.bitPerm(); got != tt.want {
+				t.Errorf("p.bitPerm() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
+func TestPermutator_SetIndexUint64(t *testing.T) {
+	p := new(Permutator).New([]int{61, 63, 65, 67}, append([]byte(nil), proFormPermutators[0].Randp...))
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	want := new(Permutator).New([]int{61, 63, 65, 67}, append([]byte(nil), proFormPermutators[0].Randp...))
+	rnd := rand.New(rand.NewSource(1))
+	idxs := []uint64{0, 1, 16736264, 16736265, 1<<64 - 1}
+	for i := 0; i < 100; i++ {
+		idxs = append(idxs, rnd.Uint64())
+	}
+	// wantState sets want to the state for block idx using big.Int arithmetic.
+	wantState := func(idx *big.Int) {
+		state := new(big.Int).Mod(idx, big.NewInt(int64(want.MaximalStates)))
+		want.CurrentState = int(state.Int64())
+		for i := range want.Cycles {
+			want.Cycles[i].Current = want.CurrentState % want.Cycles[i].Length
+		}
+	}
+	for _, idx := range idxs {
+		bigIdx := new(big.Int).SetUint64(idx)
+		p.SetIndexUint64(idx)
+		wantState(bigIdx)
+		if !reflect.DeepEqual(p.Cycles, want.Cycles) || p.CurrentState != want.CurrentState {
+			t.Fatalf("SetIndexUint64(%d): p.Cycles = %v, want %v", idx, p.Cycles, want.Cycles)
+		}
+		n := rnd.Uint64()
+		p.Skip(n)
+		wantState(bigIdx.Add(bigIdx, new(big.Int).SetUint64(n)))
+		if !reflect.DeepEqual(p.Cycles, want.Cycles) || p.CurrentState != want.CurrentState {
+			t.Fatalf("Skip(%d) from %d: p.Cycles = %v, want %v", n, idx, p.Cycles, want.Cycles)
+		}
+		p.SetIndex(bigIdx.Add(bigIdx, huge))
+		wantState(bigIdx)
+		if !reflect.DeepEqual(p.Cycles, want.Cycles) || p.CurrentState != want.CurrentState {
+			t.Fatalf("SetIndex(%s): p.Cycles = %v, want %v", bigIdx, p.Cycles, want.Cycles)
+		}
+	}
+}
+
 func TestPermutator_Index(t *testing.T) {
 	tests := []struct {
 		name string
@@ -293,6 +334,71 @@ func TestPermutator_ApplyG(t *testing.T) {
 	}
 }
 
+func TestPermutator_ApplyFTo(t *testing.T) {
+	tests := []struct {
+		name string
+		src  CipherBlock
+		want CipherBlock
+	}{
+		{
+			name: "tpfto1",
+			src: []byte{
+				1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+				17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32,
+			},
+			want: []byte{
+				209, 217, 128, 24, 115, 4, 114, 33, 6, 18, 17, 204, 16, 160, 173, 86,
+				133, 128, 48, 33, 152, 233, 34, 224, 3, 136, 162, 192, 32, 5, 2, 4,
+			},
+		},
+		{
+			name: "tpfto2",
+			src:  []byte{1, 2, 3, 4},
+			want: []byte{1, 2, 3, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := new(Permutator).New(cycleLengths(proFormPermutators[0]), append([]byte(nil), proFormPermutators[0].Randp...))
+			// Permute in place.
+			p.ApplyFTo(tt.src, tt.src)
+			if !reflect.DeepEqual(tt.src, tt.want) {
+				t.Errorf("Permutator.ApplyFTo() = %v, want %v", tt.src, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermutator_ApplyGTo(t *testing.T) {
+	tests := []struct {
+		name string
+		src  CipherBlock
+		want CipherBlock
+	}{
+		{
+			name: "tpgto1",
+			src: []byte{
+				209, 217, 128, 24, 115, 4, 114, 33, 6, 18, 17, 204, 16, 160, 173, 86,
+				133, 128, 48, 33, 152, 233, 34, 224, 3, 136, 162, 192, 32, 5, 2, 4,
+			},
+			want: []byte{
+				1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+				17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := new(Permutator).New(cycleLengths(proFormPermutators[0]), append([]byte(nil), proFormPermutators[0].Randp...))
+			dst := make(CipherBlock, CipherBlockBytes)
+			p.ApplyGTo(dst, tt.src)
+			if !reflect.DeepEqual(dst, tt.want) {
+				t.Errorf("Permutator.ApplyGTo() = %v, want %v", dst, tt.want)
+			}
+		})
+	}
+}
+
 func TestPermutator_String(t *testing.T) {
 	tests := []struct {
 		name string
@@ -328,3 +434,221 @@ func TestPermutator_String(t *testing.T) {
 		})
 	}
 }
+
+// origCycle is the original implementation of Permutator.cycle() that
+// used a goroutine for each cycle to build the permutation table.  It is
+// used to verify and benchmark the current implementation.
+func origCycle(p *Permutator, bitPerm *[CipherBlockSize]byte) {
+	var wg sync.WaitGroup
+	for cycleIdx := range p.Cycles {
+		wg.Add(1)
+		go func(cIdx int) {
+			defer wg.Done()
+			curCycle := p.Cycles[cIdx]
+			cycle := p.Randp[curCycle.Start : curCycle.Start+curCycle.Length]
+			sIdx := curCycle.Current
+			length := curCycle.Length
+			for _, val := range cycle {
+				bitPerm[val] = p.Randp[cycle[sIdx]]
+				sIdx = (sIdx + 1) % length
+			}
+		}(cycleIdx)
+	}
+	wg.Wait()
+}
+
+// origApplyF is the original implementation of Permutator.ApplyF() that
+// permuted the block one bit at a time using the permutation table.
+func origApplyF(p *Permutator, bitPerm *[CipherBlockSize]byte, blk CipherBlock) CipherBlock {
+	ress := make([]byte, CipherBlockBytes)
+	for i, v := range bitPerm {
+		if GetBit(blk, uint(i)) {
+			SetBit(ress, uint(v))
+		}
+	}
+	p.nextState()
+	origCycle(p, bitPerm)
+	return ress
+}
+
+// origApplyG is the original implementation of Permutator.ApplyG().
+func origApplyG(p *Permutator, bitPerm *[CipherBlockSize]byte, blk CipherBlock) CipherBlock {
+	ress := make([]byte, CipherBlockBytes)
+	for i, v := range bitPerm {
+		if GetBit(blk, uint(v)) {
+			SetBit(ress, uint(i))
+		}
+	}
+	p.nextState()
+	origCycle(p, bitPerm)
+	return ress
+}
+
+func TestPermutator_bitPerm(t *testing.T) {
+	tests := []struct {
+		name   string
+		states int
+	}{
+		{
+			name:   "tpbp1",
+			states: 10000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := new(Permutator).New(cycleLengths(proFormPermutators[0]), append([]byte(nil), proFormPermutators[0].Randp...))
+			var want [CipherBlockSize]byte
+			for i := 0; i < tt.states; i++ {
+				p.nextState()
+				origCycle(p, &want)
+				if got := p.bitPerm(); got != want {
+					t.Fatalf("state %d: p.bitPerm() = %v, want %v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPermutator_lookupTables(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	randp := make([]byte, CipherBlockSize)
+	for i, v := range rnd.Perm(CipherBlockSize) {
+		randp[i] = byte(v)
+	}
+	tests := []struct {
+		name   string
+		cycles []int
+		randp  []byte
+	}{
+		{
+			name:   "tplt1",
+			cycles: cycleLengths(proFormPermutators[0]),
+			randp:  proFormPermutators[0].Randp,
+		},
+		{
+			name:   "tplt2",
+			cycles: []int{1, 2, 100, 153},
+			randp:  randp,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := new(Permutator).New(tt.cycles, append([]byte(nil), tt.randp...))
+			want := new(Permutator).New(tt.cycles, append([]byte(nil), tt.randp...))
+			pG := new(Permutator).New(tt.cycles, append([]byte(nil), tt.randp...))
+			wantG := new(Permutator).New(tt.cycles, append([]byte(nil), tt.randp...))
+			var bitPerm, bitPermG [CipherBlockSize]byte
+			origCycle(want, &bitPerm)
+			origCycle(wantG, &bitPermG)
+			blk := make(CipherBlock, CipherBlockBytes)
+			for i := 0; i < 1000; i++ {
+				rnd.Read(blk)
+				wantBlk := origApplyF(want, &bitPerm, blk)
+				if got := p.ApplyF(blk); !reflect.DeepEqual(got, wantBlk) {
+					t.Fatalf("block %d: Permutator.ApplyF() = %v, want %v", i, got, wantBlk)
+				}
+				wantBlk = origApplyG(wantG, &bitPermG, blk)
+				if got := pG.ApplyG(blk); !reflect.DeepEqual(got, wantBlk) {
+					t.Fatalf("block %d: Permutator.ApplyG() = %v, want %v", i, got, wantBlk)
+				}
+			}
+		})
+	}
+}
+
+func TestPermutator_lazyTables(t *testing.T) {
+	// A permutator that was not created by New or Update builds its
+	// tables before the first block is permuted.
+	rnd := rand.New(rand.NewSource(2))
+	blk := make(CipherBlock, CipherBlockBytes)
+	rnd.Read(blk)
+	want := new(Permutator).New(cycleLengths(proFormPermutators[0]), append([]byte(nil), proFormPermutators[0].Randp...))
+	encoded, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := new(Permutator)
+	if err = json.Unmarshal(encoded, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.fwdTables != nil || p.invTables != nil {
+		t.Fatalf("the decoded permutator has lookup tables")
+	}
+	var bitPerm [CipherBlockSize]byte
+	origCycle(want, &bitPerm)
+	if got, wantBlk := p.ApplyF(append(CipherBlock(nil), blk...)), origApplyF(want, &bitPerm, append(CipherBlock(nil), blk...)); !reflect.DeepEqual(got, wantBlk) {
+		t.Errorf("Permutator.ApplyF() of a decoded permutator = %v, want %v", got, wantBlk)
+	}
+	p.SetIndexUint64(0)
+	want.SetIndexUint64(0)
+	origCycle(want, &bitPerm)
+	if got, wantBlk := p.ApplyG(append(CipherBlock(nil), blk...)), origApplyG(want, &bitPerm, append(CipherBlock(nil), blk...)); !reflect.DeepEqual(got, wantBlk) {
+		t.Errorf("Permutator.ApplyG() of a decoded permutator = %v, want %v", got, wantBlk)
+	}
+}
+
+func BenchmarkOrigPermutatorCycle(b *testing.B) {
+	p := new(Permutator).New(cycleLengths(proFormPermutators[0]), append([]byte(nil), proFormPermutators[0].Randp...))
+	var bitPerm [CipherBlockSize]byte
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		origCycle(p, &bitPerm)
+	}
+}
+
+func BenchmarkPermutatorBitPerm(b *testing.B) {
+	p := new(Permutator).New(cycleLengths(proFormPermutators[0]), append([]byte(nil), proFormPermutators[0].Randp...))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = p.bitPerm()
+	}
+}
+
+func BenchmarkOrigPermutatorApplyF(b *testing.B) {
+	p := new(Permutator).New(cycleLengths(proFormPermutators[0]), append([]byte(nil), proFormPermutators[0].Randp...))
+	var bitPerm [CipherBlockSize]byte
+	origCycle(p, &bitPerm)
+	blk := make(CipherBlock, CipherBlockBytes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		blk = origApplyF(p, &bitPerm, blk)
+	}
+}
+
+func BenchmarkPermutatorApplyF(b *testing.B) {
+	p := new(Permutator).New(cycleLengths(proFormPermutators[0]), append([]byte(nil), proFormPermutators[0].Randp...))
+	blk := make(CipherBlock, CipherBlockBytes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		blk = p.ApplyF(blk)
+	}
+}
+
+func BenchmarkOrigPermutatorApplyG(b *testing.B) {
+	p := new(Permutator).New(cycleLengths(proFormPermutators[0]), append([]byte(nil), proFormPermutators[0].Randp...))
+	var bitPerm [CipherBlockSize]byte
+	origCycle(p, &bitPerm)
+	blk := make(CipherBlock, CipherBlockBytes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		blk = origApplyG(p, &bitPerm, blk)
+	}
+}
+
+func BenchmarkPermutatorApplyG(b *testing.B) {
+	p := new(Permutator).New(cycleLengths(proFormPermutators[0]), append([]byte(nil), proFormPermutators[0].Randp...))
+	blk := make(CipherBlock, CipherBlockBytes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		blk = p.ApplyG(blk)
+	}
+}
+
+func BenchmarkPermutatorApplyFTo(b *testing.B) {
+	p := new(Permutator).New(cycleLengths(proFormPermutators[0]), append([]byte(nil), proFormPermutators[0].Randp...))
+	blk := make(CipherBlock, CipherBlockBytes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.ApplyFTo(blk, blk)
+	}
+}
@@ -0,0 +1,163 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the EnginePool type, which holds a number of clones of a Tnt2Engine
+// for servers that encrypt many messages at the same time.
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"sync/atomic"
+)
+
+// EnginePool holds a fixed number of clones of an initialized Tnt2Engine.  An
+// engine is handed out by Acquire, positioned at the start of a range of
+// blocks reserved from a counter shared by all of the engines in the pool, so
+// no two messages are ever encrypted using the same block numbers.  The engine
+// is handed back with Release.  An EnginePool is safe for concurrent use.
+type EnginePool struct {
+	idle     chan *Tnt2Engine
+	size     int
+	template *Tnt2Engine // Cloned to replace an engine released closed.
+	mu       sync.Mutex
+	acquired map[*Tnt2Engine]bool // The engines that have not been released.
+	base     *big.Int             // The block number of the first block reserved.
+	reserved atomic.Uint64        // The number of blocks reserved after base.
+	acquires atomic.Uint64
+	waits    atomic.Uint64
+	inUse    atomic.Int64
+}
+
+// PoolStats holds statistics about the use of an EnginePool.
+type PoolStats struct {
+	Size           int    // The number of engines in the pool.
+	Idle           int    // The number of engines waiting to be acquired.
+	InUse          int    // The number of engines that have been acquired.
+	Acquires       uint64 // The number of times an engine was acquired.
+	Waits          uint64 // The number of acquires that had to wait for an idle engine.
+	BlocksReserved uint64 // The number of blocks reserved by all acquires.
+}
+
+// NewEnginePool creates a pool of size clones of e, which must have been
+// initialized.  The first range of blocks reserved starts at e.Index().  Since
+// the engines are cloned, Init is only called once for the whole pool.
+func NewEnginePool(e *Tnt2Engine, size int) *EnginePool {
+	if size <= 0 {
+		panic("the pool must hold at least one engine!")
+	}
+	p := new(EnginePool)
+	p.idle = make(chan *Tnt2Engine, size)
+	p.size = size
+	p.template = e.Clone()
+	p.acquired = make(map[*Tnt2Engine]bool)
+	p.base = new(big.Int)
+	if idx := e.Index(); idx != nil {
+		p.base.Set(idx)
+	}
+	for i := 0; i < size; i++ {
+		p.idle <- e.Clone()
+	}
+	return p
+}
+
+// Index returns the block number of the next block to be reserved.
+func (p *EnginePool) Index() *big.Int {
+	return p.blockNumber(p.reserved.Load())
+}
+
+// blockNumber returns the block number that is offset blocks after base.
+func (p *EnginePool) blockNumber(offset uint64) *big.Int {
+	return new(big.Int).Add(p.base, new(big.Int).SetUint64(offset))
+}
+
+// Acquire waits for an idle engine (or for ctx to be done), reserves the next
+// blocks blocks, and returns the engine positioned at the first of them along
+// with its block number.  The engine must be used for at most blocks blocks
+// before it is handed back with Release.
+func (p *EnginePool) Acquire(ctx context.Context, blocks uint64) (*Tnt2Engine, *big.Int, error) {
+	var e *Tnt2Engine
+	select {
+	case e = <-p.idle:
+	default:
+		p.waits.Add(1)
+		select {
+		case e = <-p.idle:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+	p.mu.Lock()
+	p.acquired[e] = true
+	p.mu.Unlock()
+	p.acquires.Add(1)
+	p.inUse.Add(1)
+	start := p.blockNumber(p.reserved.Add(blocks) - blocks)
+	e.SetIndex(start)
+	return e, start, nil
+}
+
+// Release hands an engine acquired from the pool back to it, closing any
+// cipher machine that is still running.  An engine that was closed (or wiped)
+// is replaced in the pool by a new clone.  Releasing an engine that was not
+// acquired from the pool, or was already released, has no effect.
+func (p *EnginePool) Release(e *Tnt2Engine) {
+	p.mu.Lock()
+	acquired := p.acquired[e]
+	delete(p.acquired, e)
+	p.mu.Unlock()
+	if !acquired {
+		return
+	}
+	switch e.State() {
+	case Running:
+		e.stopMachine()
+	case Closed, Uninitialized:
+		e = p.template.Clone()
+	}
+	p.inUse.Add(-1)
+	p.idle <- e
+}
+
+// Stats returns the current statistics of the pool.
+func (p *EnginePool) Stats() PoolStats {
+	return PoolStats{
+		Size:           p.size,
+		Idle:           len(p.idle),
+		InUse:          int(p.inUse.Load()),
+		Acquires:       p.acquires.Load(),
+		Waits:          p.waits.Load(),
+		BlocksReserved: p.reserved.Load(),
+	}
+}
+
+// Encrypt acquires an engine, encrypts plaintext as a single message, and
+// releases the engine.  It returns the ciphertext and the block number the
+// message was encrypted at, which is needed to decrypt it.
+func (p *EnginePool) Encrypt(ctx context.Context, plaintext []byte) (ciphertext []byte, start *big.Int, err error) {
+	blocks := uint64((len(plaintext) + CipherBlockBytes - 1) / CipherBlockBytes)
+	e, start, err := p.Acquire(ctx, blocks)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer p.Release(e)
+	ciphertext, err = runMachine(e, "E", plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ciphertext, start, nil
+}
+
+// Decrypt acquires an engine, decrypts ciphertext that was encrypted at the
+// block number start, and releases the engine.  No blocks are reserved.
+func (p *EnginePool) Decrypt(ctx context.Context, ciphertext []byte, start *big.Int) ([]byte, error) {
+	e, _, err := p.Acquire(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Release(e)
+	e.SetIndex(start)
+	return runMachine(e, "D", ciphertext)
+}
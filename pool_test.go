@@ -0,0 +1,230 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestTnt2Engine_Clone(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	tnt2Machine.SetIndex(big.NewInt(1000))
+	clone := tnt2Machine.Clone()
+	if clone.State() != Ready {
+		t.Errorf("Clone().State() = %v, want %v", clone.State(), Ready)
+	}
+	if clone.CounterKey() != tnt2Machine.CounterKey() {
+		t.Errorf("Clone().CounterKey() = %s, want %s", clone.CounterKey(), tnt2Machine.CounterKey())
+	}
+	if clone.Index().Cmp(tnt2Machine.Index()) != 0 {
+		t.Errorf("Clone().Index() = %s, want %s", clone.Index(), tnt2Machine.Index())
+	}
+	data := make([]byte, 10*CipherBlockBytes+5)
+	rand.New(rand.NewSource(1)).Read(data)
+	want, err := runMachine(&tnt2Machine, "E", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := runMachine(clone, "E", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("the clone did not encrypt the same as the original engine")
+	}
+	// Using the clone must not change the state of the original.
+	tnt2Machine.SetIndex(BigZero)
+	before := engineState(&tnt2Machine)
+	clone.SetIndex(big.NewInt(12345))
+	if _, err := runMachine(clone, "E", data); err != nil {
+		t.Fatal(err)
+	}
+	if after := engineState(&tnt2Machine); !reflect.DeepEqual(after, before) {
+		t.Errorf("using the clone changed the state of the original engine")
+	}
+	if tnt2Machine.Index().Sign() != 0 {
+		t.Errorf("using the clone changed the original Index() to %s", tnt2Machine.Index())
+	}
+}
+
+func TestTnt2Engine_InitConcurrent(t *testing.T) {
+	var want Tnt2Engine
+	want.Init([]byte("SecretKey"), "")
+	engines := make([]Tnt2Engine, 4)
+	var wg sync.WaitGroup
+	for i := range engines {
+		wg.Add(1)
+		go func(e *Tnt2Engine) {
+			defer wg.Done()
+			e.Init([]byte("SecretKey"), "")
+		}(&engines[i])
+	}
+	wg.Wait()
+	for i := range engines {
+		if got := engines[i].CounterKey(); got != want.CounterKey() {
+			t.Errorf("engine %d CounterKey() = %s, want %s", i, got, want.CounterKey())
+		}
+	}
+}
+
+func TestEnginePool_Encrypt(t *testing.T) {
+	const goroutines, messages, poolSize = 16, 20, 4
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	tnt2Machine.SetIndex(big.NewInt(7))
+	pool := NewEnginePool(&tnt2Machine, poolSize)
+	type result struct {
+		plaintext, ciphertext []byte
+		start                 *big.Int
+	}
+	results := make([][]result, goroutines)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for m := 0; m < messages; m++ {
+				plaintext := make([]byte, rnd.Intn(4*CipherBlockBytes)+1)
+				rnd.Read(plaintext)
+				ciphertext, start, err := pool.Encrypt(context.Background(), plaintext)
+				if err != nil {
+					t.Errorf("EnginePool.Encrypt() error = %v", err)
+					return
+				}
+				results[g] = append(results[g], result{plaintext, ciphertext, start})
+			}
+		}(g)
+	}
+	wg.Wait()
+	var all []result
+	for _, r := range results {
+		all = append(all, r...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].start.Cmp(all[j].start) < 0 })
+	next := big.NewInt(7)
+	var blocks uint64
+	for _, r := range all {
+		if r.start.Cmp(next) != 0 {
+			t.Fatalf("message encrypted at block %s, want %s", r.start, next)
+		}
+		n := (len(r.plaintext) + CipherBlockBytes - 1) / CipherBlockBytes
+		next.Add(next, big.NewInt(int64(n)))
+		blocks += uint64(n)
+	}
+	if got := pool.Index(); got.Cmp(next) != 0 {
+		t.Errorf("EnginePool.Index() = %s, want %s", got, next)
+	}
+	stats := pool.Stats()
+	wantStats := PoolStats{
+		Size:           poolSize,
+		Idle:           poolSize,
+		InUse:          0,
+		Acquires:       goroutines * messages,
+		Waits:          stats.Waits,
+		BlocksReserved: blocks,
+	}
+	if stats != wantStats {
+		t.Errorf("EnginePool.Stats() = %+v, want %+v", stats, wantStats)
+	}
+	// Check the results using a separate engine.
+	var check Tnt2Engine
+	check.Init([]byte("SecretKey"), "")
+	s := NewSharedEngine(&check)
+	for _, r := range all {
+		plaintext, err := s.Decrypt(r.ciphertext, r.start)
+		if err != nil {
+			t.Fatalf("SharedEngine.Decrypt() error = %v", err)
+		}
+		if !bytes.Equal(plaintext, r.plaintext) {
+			t.Fatalf("message at block %s did not decrypt correctly", r.start)
+		}
+		plaintext, err = pool.Decrypt(context.Background(), r.ciphertext, r.start)
+		if err != nil {
+			t.Fatalf("EnginePool.Decrypt() error = %v", err)
+		}
+		if !bytes.Equal(plaintext, r.plaintext) {
+			t.Fatalf("EnginePool.Decrypt() did not decrypt the message at block %s", r.start)
+		}
+	}
+}
+
+func TestEnginePool_Acquire(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	pool := NewEnginePool(&tnt2Machine, 1)
+	e, start, err := pool.Acquire(context.Background(), 3)
+	if err != nil {
+		t.Fatalf("EnginePool.Acquire() error = %v", err)
+	}
+	if start.Sign() != 0 || e.Index().Sign() != 0 {
+		t.Errorf("EnginePool.Acquire() start = %s, Index() = %s, want 0", start, e.Index())
+	}
+	// Leave a cipher machine running; Release must close it.
+	e.SetEngineType("E")
+	e.BuildCipherMachine()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := pool.Acquire(ctx, 1); err != context.Canceled {
+		t.Errorf("EnginePool.Acquire() with no idle engines error = %v, want %v", err, context.Canceled)
+	}
+	if got := pool.Stats(); got.InUse != 1 || got.Idle != 0 || got.Waits != 1 {
+		t.Errorf("EnginePool.Stats() = %+v, want 1 in use, 0 idle, 1 wait", got)
+	}
+	pool.Release(e)
+	if e.State() != Ready {
+		t.Errorf("State() after Release = %v, want %v", e.State(), Ready)
+	}
+	e, start, err = pool.Acquire(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("EnginePool.Acquire() error = %v", err)
+	}
+	if start.Cmp(big.NewInt(3)) != 0 || e.Index().Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("EnginePool.Acquire() start = %s, Index() = %s, want 3", start, e.Index())
+	}
+	// A closed engine is replaced, and releasing it twice has no effect.
+	want, _ := runMachine(e, "E", make([]byte, 2*CipherBlockBytes))
+	e.Close()
+	pool.Release(e)
+	pool.Release(e)
+	if got := pool.Stats(); got.InUse != 0 || got.Idle != 1 {
+		t.Errorf("EnginePool.Stats() after releasing twice = %+v, want 0 in use, 1 idle", got)
+	}
+	e, start, err = pool.Acquire(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("EnginePool.Acquire() error = %v", err)
+	}
+	if e.State() != Ready || start.Cmp(big.NewInt(4)) != 0 {
+		t.Errorf("EnginePool.Acquire() after releasing a closed engine: State() = %v, start = %s", e.State(), start)
+	}
+	e.SetIndex(big.NewInt(3))
+	if got, err := runMachine(e, "E", make([]byte, 2*CipherBlockBytes)); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("the engine replacing a closed engine does not encrypt the same way: %v", err)
+	}
+	pool.Release(e)
+}
+
+func BenchmarkEnginePool_Encrypt(b *testing.B) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	pool := NewEnginePool(&tnt2Machine, 8)
+	record := make([]byte, 4*CipherBlockBytes)
+	b.SetBytes(int64(len(record)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, _, err := pool.Encrypt(context.Background(), record); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -149,10 +149,8 @@ func (rnd *Rand) Read(p []byte) (n int, err error) {
 	// bytes that are based on the secret key so that the same sequence
 	// will be generated.
 	if string(rnd.blk) == string(emptyBlk) {
-		cntrKeyBytes := rnd.tnt2Machine.cntrKey[:]
-		cntrKeyBytes = jc1Key.XORKeyStream(cntrKeyBytes)
 		rnd.blk = make(CipherBlock, CipherBlockBytes)
-		_ = copy(rnd.blk[:], cntrKeyBytes)
+		_ = copy(rnd.blk[:], rnd.tnt2Machine.randSeed)
 	}
 	// Clear out p to receive the pseudo-random data.
 	p = p[:0]
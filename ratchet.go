@@ -0,0 +1,164 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the Ratchet type, which replaces the engine of a long-lived session
+// with a new one at regular intervals so that past messages stay secret.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// Errors returned by a Ratchet.
+var (
+	ErrRatchetOrder  = errors.New("tnt2engine: message is out of order for the ratchet")
+	errRatchetConfig = errors.New("tnt2engine: the ratchet needs a message or block limit")
+)
+
+// ratchetBlocks is encrypted, after the last message of an epoch, to give the
+// secret key of the next epoch.
+var ratchetBlocks = [2 * CipherBlockBytes]byte{'t', 'n', 't', '2', 'e', 'n', 'g', 'i', 'n', 'e', ' ', 'r', 'a', 't', 'c', 'h', 'e', 't'}
+
+// RatchetConfig sets when a Ratchet moves to a new engine.  At least one of
+// Messages and Blocks must be set.
+type RatchetConfig struct {
+	// Messages is the number of messages encrypted with each engine, or
+	// zero for no limit.
+	Messages uint64
+	// Blocks is the number of blocks after which no more messages are
+	// encrypted with an engine, or zero for no limit.  The message that
+	// reaches the limit is still encrypted with the engine, so it may use
+	// more blocks than the limit.
+	Blocks uint64
+	// ProFormaFile is the proforma machine passed to Init for every
+	// engine, or "" for the default one.
+	ProFormaFile string
+}
+
+// Ratchet encrypts (or decrypts) a sequence of messages, moving to a new
+// engine at the end of each epoch, as set by its RatchetConfig.  The secret
+// key of the new engine is derived from the key stream of the old engine,
+// which is then wiped.  Someone who learns the current state of the ratchet can
+// not recover the engines of earlier epochs, so the messages sent in those
+// epochs stay secret.
+//
+// The sender and the receiver of the messages each create a Ratchet from the
+// same secret key and config.  The receiver must decrypt the messages in the
+// order they were encrypted, which it checks using the message index returned
+// by Encrypt, so that both move to a new engine after the same message.  A
+// Ratchet must only be used in one direction: a session where both sides send
+// messages needs two of them, created from different secret keys.  A Ratchet
+// is safe for concurrent use.
+type Ratchet struct {
+	mu     sync.Mutex
+	e      *Tnt2Engine
+	config RatchetConfig
+	epoch  uint64 // The number of times the engine has been replaced.
+	index  uint64 // The index of the next message.
+	count  uint64 // The number of messages in the current epoch.
+	next   uint64 // The block number of the next message in the current epoch.
+}
+
+// NewRatchet returns a Ratchet whose first engine is created from secret.
+func NewRatchet(secret []byte, config RatchetConfig) (*Ratchet, error) {
+	if config.Messages == 0 && config.Blocks == 0 {
+		return nil, errRatchetConfig
+	}
+	r := new(Ratchet)
+	r.config = config
+	r.e = new(Tnt2Engine)
+	r.e.Init(secret, config.ProFormaFile)
+	return r, nil
+}
+
+// Epoch returns the number of times the engine has been replaced.
+func (r *Ratchet) Epoch() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.epoch
+}
+
+// Index returns the index of the next message to be encrypted (or decrypted).
+func (r *Ratchet) Index() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.index
+}
+
+// Encrypt encrypts plaintext as the next message, returning the ciphertext and
+// the index of the message, which the receiver passes to Decrypt.
+func (r *Ratchet) Encrypt(plaintext []byte) (ciphertext []byte, index uint64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	index = r.index
+	ciphertext, err = r.run("E", plaintext)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ciphertext, index, nil
+}
+
+// Decrypt decrypts ciphertext, which must be the message with the given index.
+// It returns ErrRatchetOrder, without changing the ratchet, if index is not
+// the index of the next message.
+func (r *Ratchet) Decrypt(ciphertext []byte, index uint64) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if index != r.index {
+		return nil, ErrRatchetOrder
+	}
+	return r.run("D", ciphertext)
+}
+
+// run passes data through a cipher machine of the given engineType, as the
+// next message, and moves to a new engine if it was the last message of the
+// epoch.  The ratchet is not changed if run returns an error.
+func (r *Ratchet) run(engineType string, data []byte) ([]byte, error) {
+	r.e.SetIndexUint64(r.next)
+	res, err := runMachine(r.e, engineType, data)
+	if err != nil {
+		return nil, err
+	}
+	count := r.count + 1
+	next := r.next + uint64((len(data)+CipherBlockBytes-1)/CipherBlockBytes)
+	if (r.config.Messages != 0 && count >= r.config.Messages) ||
+		(r.config.Blocks != 0 && next >= r.config.Blocks) {
+		if err = r.advance(next); err != nil {
+			return nil, err
+		}
+	} else {
+		r.count = count
+		r.next = next
+	}
+	r.index++
+	return res, nil
+}
+
+// advance replaces the engine with one created from a secret key derived from
+// the key stream of the engine at the block number next, which follows the
+// last message of the epoch.
+func (r *Ratchet) advance(next uint64) error {
+	r.e.SetIndexUint64(next)
+	stream, err := runMachine(r.e, "E", ratchetBlocks[:])
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, r.epoch)
+	h.Write(stream)
+	secret := h.Sum(nil)
+	e := new(Tnt2Engine)
+	e.Init(secret, r.config.ProFormaFile)
+	zeroBytes(stream)
+	zeroBytes(secret)
+	r.e.Wipe()
+	r.e = e
+	r.epoch++
+	r.count = 0
+	r.next = 0
+	return nil
+}
@@ -0,0 +1,107 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestRatchet(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    RatchetConfig
+		sizes     []int // The sizes of the messages, in bytes.
+		wantEpoch []uint64
+	}{
+		{
+			name:      "tr1",
+			config:    RatchetConfig{Messages: 3},
+			sizes:     []int{10, 100, 0, 64, 1, 33, 500, 32},
+			wantEpoch: []uint64{0, 0, 1, 1, 1, 2, 2, 2},
+		},
+		{
+			name:      "tr2",
+			config:    RatchetConfig{Blocks: 4},
+			sizes:     []int{64, 33, 32, 200, 0, 31, 96},
+			wantEpoch: []uint64{0, 1, 1, 2, 2, 2, 3},
+		},
+		{
+			name:      "tr3",
+			config:    RatchetConfig{Messages: 2, Blocks: 4},
+			sizes:     []int{10, 10, 150, 10, 10, 10},
+			wantEpoch: []uint64{0, 1, 2, 2, 3, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, err := NewRatchet([]byte("SecretKey"), tt.config)
+			if err != nil {
+				t.Fatalf("NewRatchet() error = %v", err)
+			}
+			receiver, _ := NewRatchet([]byte("SecretKey"), tt.config)
+			rnd := rand.New(rand.NewSource(1))
+			for i, size := range tt.sizes {
+				plaintext := make([]byte, size)
+				rnd.Read(plaintext)
+				ciphertext, index, err := sender.Encrypt(plaintext)
+				if err != nil {
+					t.Fatalf("Ratchet.Encrypt() error = %v", err)
+				}
+				if index != uint64(i) {
+					t.Errorf("Ratchet.Encrypt() index = %d, want %d", index, i)
+				}
+				if size > 0 && bytes.Equal(ciphertext, plaintext) {
+					t.Errorf("message %d was not encrypted", i)
+				}
+				got, err := receiver.Decrypt(ciphertext, index)
+				if err != nil {
+					t.Fatalf("Ratchet.Decrypt() error = %v", err)
+				}
+				if !bytes.Equal(got, plaintext) {
+					t.Errorf("message %d: Ratchet.Decrypt() did not return the plaintext", i)
+				}
+				if got := sender.Epoch(); got != tt.wantEpoch[i] {
+					t.Errorf("message %d: Ratchet.Epoch() = %d, want %d", i, got, tt.wantEpoch[i])
+				}
+				if sender.Epoch() != receiver.Epoch() || sender.Index() != receiver.Index() {
+					t.Errorf("message %d: the sender and the receiver are out of step", i)
+				}
+			}
+		})
+	}
+}
+
+func TestRatchet_Decrypt(t *testing.T) {
+	config := RatchetConfig{Messages: 1}
+	sender, _ := NewRatchet([]byte("SecretKey"), config)
+	receiver, _ := NewRatchet([]byte("SecretKey"), config)
+	message := []byte("The same message is sent twice.")
+	first, _, _ := sender.Encrypt(message)
+	second, index, _ := sender.Encrypt(message)
+	if bytes.Equal(first, second) {
+		t.Errorf("the message was encrypted the same way in both epochs")
+	}
+	if _, err := receiver.Decrypt(second, index); err != ErrRatchetOrder {
+		t.Errorf("Ratchet.Decrypt() of a later message error = %v, want %v", err, ErrRatchetOrder)
+	}
+	if got, err := receiver.Decrypt(first, 0); err != nil || !bytes.Equal(got, message) {
+		t.Errorf("Ratchet.Decrypt() = %q, %v, want %q", got, err, message)
+	}
+	if _, err := receiver.Decrypt(first, 0); err != ErrRatchetOrder {
+		t.Errorf("Ratchet.Decrypt() of a replayed message error = %v, want %v", err, ErrRatchetOrder)
+	}
+	// The engine of the first epoch has been wiped.
+	old := receiver.e
+	if got, err := receiver.Decrypt(second, index); err != nil || !bytes.Equal(got, message) {
+		t.Errorf("Ratchet.Decrypt() = %q, %v, want %q", got, err, message)
+	}
+	if old.State() != Closed || old.engine != nil {
+		t.Errorf("the engine of the previous epoch was not wiped")
+	}
+	if _, err := NewRatchet([]byte("SecretKey"), RatchetConfig{}); err != errRatchetConfig {
+		t.Errorf("NewRatchet() without limits error = %v, want %v", err, errRatchetConfig)
+	}
+}
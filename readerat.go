@@ -0,0 +1,134 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the DecryptReaderAt type, which decrypts any part of the ciphertext
+// without decrypting everything before it.
+
+import (
+	"errors"
+	"io"
+	"math/big"
+	"sync"
+)
+
+var (
+	errNegativeOffset = errors.New("tnt2engine: negative offset")
+	errWhence         = errors.New("tnt2engine: invalid whence")
+	errUnknownSize    = errors.New("tnt2engine: the size of the ciphertext is unknown")
+)
+
+// DecryptReaderAt decrypts ciphertext that was encrypted as a single message
+// starting at a given block number.  Since block k of the message only depends
+// on the state of the engine after SetIndex(start+k), any byte range can be
+// decrypted by positioning the engine at the first block of the range.  It
+// implements io.ReaderAt and io.ReadSeeker and is safe for concurrent use.
+type DecryptReaderAt struct {
+	mu     sync.Mutex // Held while the engine is used.
+	r      io.ReaderAt
+	e      *Tnt2Engine
+	start  *big.Int
+	offMu  sync.Mutex // Held for the whole of a Read or Seek.
+	offset int64      // The offset of the next Read.
+}
+
+// NewDecryptReaderAt returns a DecryptReaderAt that decrypts ciphertext, which
+// was encrypted by e starting at the block number startIndex.  The engine is
+// cloned, so e can continue to be used on its own.  Seeking relative to the end
+// of the ciphertext requires ciphertext to have a Size() method (as
+// bytes.Reader and io.SectionReader do) or to be an io.Seeker (as os.File is).
+func NewDecryptReaderAt(ciphertext io.ReaderAt, e *Tnt2Engine, startIndex *big.Int) *DecryptReaderAt {
+	d := new(DecryptReaderAt)
+	d.r = ciphertext
+	d.e = e.Clone()
+	d.start = new(big.Int).Set(startIndex)
+	return d
+}
+
+// ReadAt decrypts len(p) bytes of plaintext starting at offset off into p.  It
+// decrypts the whole blocks containing the range, starting with the engine
+// positioned at the first of them, so the short trailing block (if any) is
+// decrypted the same way it was encrypted.
+func (d *DecryptReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	firstBlk := off / int64(CipherBlockBytes)
+	lastBlk := (off + int64(len(p)) - 1) / int64(CipherBlockBytes)
+	blkOff := firstBlk * int64(CipherBlockBytes)
+	buf := make([]byte, (lastBlk-firstBlk+1)*int64(CipherBlockBytes))
+	cnt, err := d.r.ReadAt(buf, blkOff)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	buf = buf[:cnt]
+	if int64(cnt) <= off-blkOff {
+		return 0, io.EOF
+	}
+	d.mu.Lock()
+	d.e.SetIndex(new(big.Int).Add(d.start, big.NewInt(firstBlk)))
+	buf, err = runMachine(d.e, "D", buf)
+	d.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	n = copy(p, buf[off-blkOff:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read decrypts up to len(p) bytes of plaintext into p, starting at the
+// current offset, and advances the offset.
+func (d *DecryptReaderAt) Read(p []byte) (n int, err error) {
+	d.offMu.Lock()
+	defer d.offMu.Unlock()
+	n, err = d.ReadAt(p, d.offset)
+	d.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset of the next Read, interpreted according to whence (see
+// io.Seeker), and returns the new offset.
+func (d *DecryptReaderAt) Seek(offset int64, whence int) (int64, error) {
+	d.offMu.Lock()
+	defer d.offMu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		size, err := d.size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, errWhence
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+// size returns the size of the ciphertext, which is the same as the size of
+// the plaintext.
+func (d *DecryptReaderAt) size() (int64, error) {
+	switch r := d.r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size(), nil
+	case io.Seeker:
+		return r.Seek(0, io.SeekEnd)
+	}
+	return 0, errUnknownSize
+}
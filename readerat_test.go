@@ -0,0 +1,177 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"bytes"
+	"io"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// readerAtOnly hides every method of the reader except ReadAt.
+type readerAtOnly struct {
+	r io.ReaderAt
+}
+
+func (r readerAtOnly) ReadAt(p []byte, off int64) (int, error) {
+	return r.r.ReadAt(p, off)
+}
+
+// encryptMessage encrypts data as a single message starting at block start.
+func encryptMessage(t *testing.T, e *Tnt2Engine, data []byte, start *big.Int) []byte {
+	t.Helper()
+	e.SetIndex(start)
+	ciphertext, err := runMachine(e, "E", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+func TestDecryptReaderAt_ReadAt(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	plaintext := make([]byte, 10*CipherBlockBytes+13)
+	rand.New(rand.NewSource(1)).Read(plaintext)
+	start := big.NewInt(500)
+	ciphertext := encryptMessage(t, &tnt2Machine, plaintext, start)
+	d := NewDecryptReaderAt(bytes.NewReader(ciphertext), &tnt2Machine, start)
+	size := int64(len(plaintext))
+	tests := []struct {
+		name    string
+		off     int64
+		n       int
+		wantN   int
+		wantEOF bool
+	}{
+		{name: "tdra1", off: 0, n: len(plaintext), wantN: len(plaintext)},
+		{name: "tdra2", off: 5, n: 10, wantN: 10},
+		{name: "tdra3", off: 30, n: 40, wantN: 40},
+		{name: "tdra4", off: 64, n: 32, wantN: 32},
+		{name: "tdra5", off: size - 20, n: 20, wantN: 20},
+		{name: "tdra6", off: size - 5, n: 3, wantN: 3},
+		{name: "tdra7", off: size - 20, n: 40, wantN: 20, wantEOF: true},
+		{name: "tdra8", off: size, n: 1, wantN: 0, wantEOF: true},
+		{name: "tdra9", off: size + 100, n: 1, wantN: 0, wantEOF: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := make([]byte, tt.n)
+			n, err := d.ReadAt(p, tt.off)
+			if n != tt.wantN {
+				t.Fatalf("DecryptReaderAt.ReadAt() n = %d, want %d", n, tt.wantN)
+			}
+			if (err == io.EOF) != tt.wantEOF || (err != nil && err != io.EOF) {
+				t.Errorf("DecryptReaderAt.ReadAt() error = %v, want EOF %v", err, tt.wantEOF)
+			}
+			if n > 0 && !bytes.Equal(p[:n], plaintext[tt.off:tt.off+int64(n)]) {
+				t.Errorf("DecryptReaderAt.ReadAt() = %x, want %x", p[:n], plaintext[tt.off:tt.off+int64(n)])
+			}
+		})
+	}
+	if _, err := d.ReadAt(make([]byte, 1), -1); err == nil {
+		t.Errorf("DecryptReaderAt.ReadAt() with a negative offset did not fail")
+	}
+	// Check every byte range that starts and ends near a block boundary.
+	for off := 0; off < len(plaintext); off += 7 {
+		for end := off + 1; end <= len(plaintext); end += 11 {
+			p := make([]byte, end-off)
+			if n, err := d.ReadAt(p, int64(off)); n != len(p) || err != nil {
+				t.Fatalf("DecryptReaderAt.ReadAt(%d:%d) = %d, %v", off, end, n, err)
+			}
+			if !bytes.Equal(p, plaintext[off:end]) {
+				t.Fatalf("DecryptReaderAt.ReadAt(%d:%d) did not decrypt correctly", off, end)
+			}
+		}
+	}
+}
+
+func TestDecryptReaderAt_ReadSeeker(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	plaintext := make([]byte, 100*CipherBlockBytes+1)
+	rand.New(rand.NewSource(2)).Read(plaintext)
+	start := big.NewInt(12345)
+	ciphertext := encryptMessage(t, &tnt2Machine, plaintext, start)
+	fileName := filepath.Join(t.TempDir(), "ciphertext")
+	if err := os.WriteFile(fileName, ciphertext, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, r := range []io.ReaderAt{bytes.NewReader(ciphertext), io.NewSectionReader(f, 0, int64(len(ciphertext))), f} {
+		d := NewDecryptReaderAt(r, &tnt2Machine, start)
+		got, err := io.ReadAll(d)
+		if err != nil {
+			t.Fatalf("io.ReadAll() error = %v", err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("io.ReadAll() did not decrypt the ciphertext")
+		}
+		pos, err := d.Seek(-100, io.SeekEnd)
+		if err != nil || pos != int64(len(plaintext)-100) {
+			t.Fatalf("DecryptReaderAt.Seek(-100, io.SeekEnd) = %d, %v", pos, err)
+		}
+		if pos, err = d.Seek(-50, io.SeekCurrent); err != nil || pos != int64(len(plaintext)-150) {
+			t.Fatalf("DecryptReaderAt.Seek(-50, io.SeekCurrent) = %d, %v", pos, err)
+		}
+		got, err = io.ReadAll(d)
+		if err != nil || !bytes.Equal(got, plaintext[len(plaintext)-150:]) {
+			t.Errorf("io.ReadAll() after Seek did not decrypt the end of the ciphertext: %v", err)
+		}
+		if _, err = d.Seek(-1, io.SeekStart); err == nil {
+			t.Errorf("DecryptReaderAt.Seek(-1, io.SeekStart) did not fail")
+		}
+	}
+	d := NewDecryptReaderAt(readerAtOnly{bytes.NewReader(ciphertext)}, &tnt2Machine, start)
+	if _, err := d.Seek(0, io.SeekEnd); err != errUnknownSize {
+		t.Errorf("DecryptReaderAt.Seek(0, io.SeekEnd) error = %v, want %v", err, errUnknownSize)
+	}
+	if pos, err := d.Seek(3*int64(CipherBlockBytes)+1, io.SeekStart); err != nil || pos != 3*int64(CipherBlockBytes)+1 {
+		t.Fatalf("DecryptReaderAt.Seek(97, io.SeekStart) = %d, %v", pos, err)
+	}
+	got, err := io.ReadAll(d)
+	if err != nil || !bytes.Equal(got, plaintext[3*CipherBlockBytes+1:]) {
+		t.Errorf("io.ReadAll() without a known size did not decrypt the ciphertext: %v", err)
+	}
+}
+
+func TestDecryptReaderAt_concurrentRead(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	plaintext := make([]byte, 50*CipherBlockBytes+7)
+	rand.New(rand.NewSource(3)).Read(plaintext)
+	start := big.NewInt(99)
+	d := NewDecryptReaderAt(bytes.NewReader(encryptMessage(t, &tnt2Machine, plaintext, start)), &tnt2Machine, start)
+	// Each byte is read by exactly one of the readers.
+	var wg sync.WaitGroup
+	var total atomic.Int64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 13)
+			for {
+				n, err := d.Read(buf)
+				total.Add(int64(n))
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := total.Load(); got != int64(len(plaintext)) {
+		t.Errorf("concurrent Reads returned %d bytes, want %d", got, len(plaintext))
+	}
+}
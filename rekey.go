@@ -0,0 +1,80 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the re-encryption of a stream with a new secret key.
+
+import (
+	"io"
+)
+
+// Rekey decrypts the stream read from src using oldE and encrypts it into a
+// new stream written to dst using newE, with the same chunk size and tail mode
+// unless opts is not nil.  The plaintext only exists in memory, one chunk at a
+// time, and every chunk is authenticated before its plaintext is encrypted
+// again.  Unless opts is not nil, a stream with a padded length is padded to
+// the same length, so the new stream is the same size as the old one.
+//
+// If store is not nil, newE starts at the block number stored for it, and the
+// block number following each chunk is stored before the chunk is written to
+// dst, so the store is never behind the blocks that have been used, even if
+// Rekey fails.  Otherwise newE starts at its current index.  The store is not
+// locked between chunks, so calls to Rekey (or anything else using the store)
+// for the same new key must not run at the same time: they would start at the
+// same block number and reuse the key stream.
+//
+// If Rekey returns an error, what was written to dst must be discarded: it is
+// not a complete stream.
+func Rekey(dst io.Writer, src io.Reader, oldE, newE *Tnt2Engine, opts *StreamOptions, store CounterStore) error {
+	sr, err := NewStreamReader(src, oldE)
+	if err != nil {
+		return err
+	}
+	keepPadding := false
+	if opts == nil {
+		header := sr.Header()
+		opts = &StreamOptions{ChunkSize: header.ChunkSize, Tail: header.Tail()}
+		if header.Padded() {
+			// The padded length is only known once the old stream has
+			// been read.
+			opts.Padding = padMinimum(0)
+			keepPadding = true
+		}
+	}
+	if store != nil {
+		next, err := store.Load(newE.CounterKey())
+		if err != nil {
+			return err
+		}
+		newE.SetIndex(next)
+		dst = &storeWriter{dst, newE, store}
+	}
+	sw, err := NewStreamWriterOptions(dst, newE, *opts)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(sw, sr); err != nil {
+		return err
+	}
+	if keepPadding {
+		sw.pad = padMinimum(sr.size)
+	}
+	return sw.Close()
+}
+
+// storeWriter stores the block number following the blocks used by e before
+// each write to w.  A StreamWriter writes each chunk, once it is encrypted, in
+// a single write.
+type storeWriter struct {
+	w     io.Writer
+	e     *Tnt2Engine
+	store CounterStore
+}
+
+func (s *storeWriter) Write(p []byte) (int, error) {
+	if err := s.store.Store(s.e.CounterKey(), s.e.Index()); err != nil {
+		return 0, err
+	}
+	return s.w.Write(p)
+}
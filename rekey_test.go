@@ -0,0 +1,109 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"bytes"
+	"math/big"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestRekey(t *testing.T) {
+	var oldE, newE Tnt2Engine
+	oldE.Init([]byte("OldSecretKey"), "")
+	newE.Init([]byte("NewSecretKey"), "")
+	plaintext := make([]byte, 5*64+17)
+	rand.New(rand.NewSource(1)).Read(plaintext)
+	oldE.SetIndex(big.NewInt(50))
+	stream := encryptStreamOptions(t, &oldE, plaintext, StreamOptions{ChunkSize: 64, Tail: TailSteal}, 100)
+	store := NewFileCounterStore(filepath.Join(t.TempDir(), "counters.json"))
+	if err := store.Store(newE.CounterKey(), big.NewInt(1000)); err != nil {
+		t.Fatal(err)
+	}
+	var starts []*big.Int
+	for i := 0; i < 2; i++ {
+		var out bytes.Buffer
+		if err := Rekey(&out, bytes.NewReader(stream), &oldE, &newE, nil, store); err != nil {
+			t.Fatalf("Rekey() error = %v", err)
+		}
+		sr, err := NewStreamReader(bytes.NewReader(out.Bytes()), &newE)
+		if err != nil {
+			t.Fatalf("NewStreamReader() of the new stream error = %v", err)
+		}
+		if h := sr.Header(); h.ChunkSize != 64 || h.Tail() != TailSteal {
+			t.Errorf("the new stream has chunk size %d and tail mode %s", h.ChunkSize, h.Tail())
+		}
+		starts = append(starts, sr.Header().Start)
+		if got, err := decryptStream(&newE, out.Bytes()); err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("decryptStream() of the new stream error = %v", err)
+		}
+		if _, err = decryptStream(&oldE, out.Bytes()); err != ErrWrongKey {
+			t.Errorf("decryptStream() of the new stream with the old key error = %v, want %v", err, ErrWrongKey)
+		}
+	}
+	blocks := int64((len(plaintext) + CipherBlockBytes - 1) / CipherBlockBytes)
+	if starts[0].Int64() != 1000 || starts[1].Int64() != 1000+blocks {
+		t.Errorf("the new streams start at %s and %s, want 1000 and %d", starts[0], starts[1], 1000+blocks)
+	}
+	if next, _ := store.Load(newE.CounterKey()); next.Int64() != 1000+2*blocks {
+		t.Errorf("the stored block number = %s, want %d", next, 1000+2*blocks)
+	}
+
+	// A changed source fails, but the store still covers the chunks that
+	// were written before the change was found.
+	bad := append([]byte(nil), stream...)
+	bad[len(bad)-1] ^= 1
+	var partial bytes.Buffer
+	if err := Rekey(&partial, bytes.NewReader(bad), &oldE, &newE, nil, store); err != ErrStreamAuth {
+		t.Errorf("Rekey() of a changed stream error = %v, want %v", err, ErrStreamAuth)
+	}
+	if partial.Len() == 0 {
+		t.Errorf("Rekey() of a changed stream wrote nothing")
+	}
+	if next, _ := store.Load(newE.CounterKey()); next.Int64() <= 1000+2*blocks || next.Cmp(newE.Index()) != 0 {
+		t.Errorf("the stored block number after a failed Rekey() = %s, want %s", next, newE.Index())
+	}
+	if err := Rekey(new(bytes.Buffer), bytes.NewReader(stream), &newE, &oldE, nil, nil); err != ErrWrongKey {
+		t.Errorf("Rekey() with the wrong old key error = %v, want %v", err, ErrWrongKey)
+	}
+
+	// The options of the new stream can be changed.
+	var out bytes.Buffer
+	newE.SetIndex(big.NewInt(7))
+	opts := &StreamOptions{ChunkSize: 128, Tail: TailPad, Padding: PadMultiple(1024)}
+	if err := Rekey(&out, bytes.NewReader(stream), &oldE, &newE, opts, nil); err != nil {
+		t.Fatalf("Rekey() with options error = %v", err)
+	}
+	sr, err := NewStreamReader(bytes.NewReader(out.Bytes()), &newE)
+	if err != nil {
+		t.Fatalf("NewStreamReader() error = %v", err)
+	}
+	if h := sr.Header(); h.ChunkSize != 128 || h.Tail() != TailPad || !h.Padded() || h.Start.Int64() != 7 {
+		t.Errorf("the new stream header = %+v", h)
+	}
+	if got, err := decryptStream(&newE, out.Bytes()); err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("decryptStream() of the new stream error = %v", err)
+	}
+
+	// Without options, a padded stream keeps its padded length.
+	padded := out.Bytes()
+	out.Reset()
+	if err := Rekey(&out, bytes.NewReader(padded), &newE, &oldE, nil, nil); err != nil {
+		t.Fatalf("Rekey() of a padded stream error = %v", err)
+	}
+	if out.Len() != len(padded) {
+		t.Errorf("Rekey() of a padded stream wrote %d bytes, want %d", out.Len(), len(padded))
+	}
+	if sr, err = NewStreamReader(bytes.NewReader(out.Bytes()), &oldE); err != nil {
+		t.Fatalf("NewStreamReader() error = %v", err)
+	}
+	if h := sr.Header(); !h.Padded() {
+		t.Errorf("the new stream is not padded")
+	}
+	if got, err := decryptStream(&oldE, out.Bytes()); err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("decryptStream() of the new stream error = %v", err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"fmt"
 	"math/big"
+	"math/bits"
 )
 
 var (
@@ -107,6 +108,8 @@ func (r *Rotor) SetIndex(idx *big.Int) {
 	// Special case if idx == 0
 	if idx.Sign() == 0 {
 		r.Current = r.Start
+	} else if idx.IsUint64() {
+		r.SetIndexUint64(idx.Uint64())
 	} else {
 		// Calculate the new r.Current:
 		// r.Current = mod(((idx * r.Step) + r.Start), r.Size) + r.Start
@@ -120,6 +123,38 @@ func (r *Rotor) SetIndex(idx *big.Int) {
 	}
 }
 
+// SetIndexUint64 is SetIndex for an index that fits in a uint64.  It uses
+// native arithmetic instead of big.Int arithmetic.
+func (r *Rotor) SetIndexUint64(idx uint64) {
+	r.Current = int(mulAddMod(idx, uint64(r.Step), uint64(r.Start), uint64(r.Size)))
+}
+
+// Skip advances the rotor by n blocks, as if n blocks had been processed.
+func (r *Rotor) Skip(n uint64) {
+	r.Current = int(mulAddMod(n, uint64(r.Step), uint64(r.Current), uint64(r.Size)))
+}
+
+// mulAddMod returns (a * b + c) mod m without overflowing.
+func mulAddMod(a, b, c, m uint64) uint64 {
+	hi, lo := bits.Mul64(a%m, b%m)
+	lo, carry := bits.Add64(lo, c%m, 0)
+	return bits.Rem64(hi+carry, lo, m)
+}
+
+// Period returns the number of blocks the rotor processes before it returns
+// to its starting position.  This is Size / gcd(Step, Size), which is Size
+// when Step and Size are relatively prime (as they are for updated rotors).
+func (r *Rotor) Period() int {
+	a, b := r.Step, r.Size
+	for b != 0 {
+		a, b = b, a%b
+	}
+	if a == 0 {
+		return 1
+	}
+	return r.Size / a
+}
+
 // Always return nil since the block count is not tracked for rotors.
 func (r *Rotor) Index() *big.Int {
 	return nil
@@ -127,9 +162,15 @@ func (r *Rotor) Index() *big.Int {
 
 // Get the number of bits in the CipherBlock from rotor r.
 func (r *Rotor) getRotorBlock(bytes int) CipherBlock {
+	ress := make([]byte, bytes)
+	r.fillRotorBlock(ress)
+	return ress
+}
+
+// fillRotorBlock fills ress with the next len(ress) bytes from rotor r.
+func (r *Rotor) fillRotorBlock(ress []byte) {
 	// This code handles short blocks to accomadate file lenghts
 	// that are not multiples of "CipherBlockBytes"
-	ress := make([]byte, bytes)
 	rotor := r.Rotor
 	sBit := r.Current & 7
 	bIdx := r.Current >> 3
@@ -139,7 +180,7 @@ func (r *Rotor) getRotorBlock(bytes int) CipherBlock {
 		copy(ress, rotor[bIdx:])
 	} else {
 		sLeft := 8 - sBit
-		for bCnt := 0; bCnt < bytes; bCnt++ {
+		for bCnt := range ress {
 			ress[bCnt] = rotor[bIdx]>>sBit |
 				(rotor[bIdx+1] << sLeft)
 			bIdx++
@@ -147,19 +188,38 @@ func (r *Rotor) getRotorBlock(bytes int) CipherBlock {
 	}
 	// Step the rotor to its new position.
 	r.Current = (r.Current + r.Step) % r.Size
-	return ress
 }
 
 // ApplyF encrypts the given block of data using the rotor r.
 func (r *Rotor) ApplyF(blk CipherBlock) CipherBlock {
-	// Add (not XOR) the rotor bits to the bits in the input block.
-	return AddBlock(blk, r.getRotorBlock(len(blk)))
+	r.ApplyFTo(blk, blk)
+	return blk
 }
 
 // ApplyG decrypts the given block of data using the rotor r.
 func (r *Rotor) ApplyG(blk CipherBlock) CipherBlock {
+	r.ApplyGTo(blk, blk)
+	return blk
+}
+
+// ApplyFTo encrypts src into dst using the rotor r.
+func (r *Rotor) ApplyFTo(dst, src CipherBlock) {
+	var key [CipherBlockBytes]byte
+	r.fillRotorBlock(key[:len(src)])
+	dst = dst[:len(src)]
+	copy(dst, src)
+	// Add (not XOR) the rotor bits to the bits in the input block.
+	AddBlock(dst, key[:len(src)])
+}
+
+// ApplyGTo decrypts src into dst using the rotor r.
+func (r *Rotor) ApplyGTo(dst, src CipherBlock) {
+	var key [CipherBlockBytes]byte
+	r.fillRotorBlock(key[:len(src)])
+	dst = dst[:len(src)]
+	copy(dst, src)
 	// Subtract (not XOR) the rotor bits from the bits in the input block.
-	return SubBlock(blk, r.getRotorBlock(len(blk)))
+	SubBlock(dst, key[:len(src)])
 }
 
 // String converts a Rotor to a string representation of the Rotor.
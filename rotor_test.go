@@ -5,6 +5,7 @@ package tnt2engine
 
 import (
 	"math/big"
+	"math/rand"
 	"reflect"
 	"testing"
 )
@@ -214,6 +215,47 @@ func TestRotor_SetIndex(t *testing.T) {
 	}
 }
 
+// bigRotorCurrent returns the position of the rotor at block idx, calculated
+// using big.Int arithmetic.
+func bigRotorCurrent(r *Rotor, idx *big.Int) int {
+	p := new(big.Int).Mul(idx, big.NewInt(int64(r.Step)))
+	p.Add(p, big.NewInt(int64(r.Start)))
+	return int(p.Mod(p, big.NewInt(int64(r.Size))).Int64())
+}
+
+func TestRotor_SetIndexUint64(t *testing.T) {
+	r := new(Rotor).New(proFormaRotors[0].Size, proFormaRotors[0].Start, proFormaRotors[0].Step, proFormaRotors[0].Rotor)
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	rnd := rand.New(rand.NewSource(1))
+	idxs := []uint64{0, 1, 10000, 1<<63 - 1, 1 << 63, 1<<64 - 1}
+	for i := 0; i < 100; i++ {
+		idxs = append(idxs, rnd.Uint64())
+	}
+	for _, idx := range idxs {
+		bigIdx := new(big.Int).SetUint64(idx)
+		r.SetIndexUint64(idx)
+		if want := bigRotorCurrent(r, bigIdx); r.Current != want {
+			t.Fatalf("SetIndexUint64(%d): r.Current = %d, want %d", idx, r.Current, want)
+		}
+		r.SetIndex(bigIdx)
+		if want := bigRotorCurrent(r, bigIdx); r.Current != want {
+			t.Fatalf("SetIndex(%d): r.Current = %d, want %d", idx, r.Current, want)
+		}
+		// Skip to a block number that may be beyond 2^64.
+		n := rnd.Uint64()
+		r.Skip(n)
+		bigIdx.Add(bigIdx, new(big.Int).SetUint64(n))
+		if want := bigRotorCurrent(r, bigIdx); r.Current != want {
+			t.Fatalf("Skip(%d) from %d: r.Current = %d, want %d", n, idx, r.Current, want)
+		}
+		bigIdx.Add(bigIdx, huge)
+		r.SetIndex(bigIdx)
+		if want := bigRotorCurrent(r, bigIdx); r.Current != want {
+			t.Fatalf("SetIndex(%s): r.Current = %d, want %d", bigIdx, r.Current, want)
+		}
+	}
+}
+
 func TestRotor_Index(t *testing.T) {
 	tests := []struct {
 		name string
@@ -326,6 +368,87 @@ func TestRotor_ApplyG(t *testing.T) {
 	}
 }
 
+func TestRotor_ApplyFTo(t *testing.T) {
+	type args struct {
+		src CipherBlock
+	}
+	tests := []struct {
+		name string
+		args args
+		want CipherBlock
+	}{
+		{
+			name: "trfto1",
+			args: args{make(CipherBlock, CipherBlockBytes)},
+			want: []byte{
+				184, 25, 190, 250, 35, 11, 111, 218, 111, 1, 44, 59, 137, 12, 184, 22,
+				154, 226, 101, 88, 167, 109, 45, 92, 19, 164, 132, 233, 34, 133, 138, 222,
+			},
+		},
+		{
+			name: "trfto2",
+			args: args{make(CipherBlock, 4)},
+			want: []byte{
+				193, 46, 58, 103,
+			},
+		},
+	}
+	r := new(Rotor).New(proFormaRotors[0].Size, proFormaRotors[0].Start,
+		proFormaRotors[0].Step, append([]byte(nil), proFormaRotors[0].Rotor...))
+	r.Current = 0
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := make(CipherBlock, CipherBlockBytes)
+			r.ApplyFTo(dst, tt.args.src)
+			if got := dst[:len(tt.args.src)]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Rotor.ApplyFTo() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.args.src, make(CipherBlock, len(tt.args.src))) {
+				t.Errorf("Rotor.ApplyFTo() modified src: %v", tt.args.src)
+			}
+		})
+	}
+}
+
+func TestRotor_ApplyGTo(t *testing.T) {
+	type args struct {
+		src CipherBlock
+	}
+	tests := []struct {
+		name string
+		args args
+		want CipherBlock
+	}{
+		{
+			name: "trgto1",
+			args: args{
+				[]byte{
+					184, 25, 190, 250, 35, 11, 111, 218, 111, 1, 44, 59, 137, 12, 184, 22,
+					154, 226, 101, 88, 167, 109, 45, 92, 19, 164, 132, 233, 34, 133, 138, 222,
+				},
+			},
+			want: make(CipherBlock, CipherBlockBytes),
+		},
+		{
+			name: "trgto2",
+			args: args{[]byte{193, 46, 58, 103}},
+			want: make(CipherBlock, 4),
+		},
+	}
+	r := new(Rotor).New(proFormaRotors[0].Size, proFormaRotors[0].Start,
+		proFormaRotors[0].Step, append([]byte(nil), proFormaRotors[0].Rotor...))
+	r.Current = 0
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Decrypt in place.
+			r.ApplyGTo(tt.args.src, tt.args.src)
+			if got := tt.args.src; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Rotor.ApplyGTo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestRotor_String(t *testing.T) {
 	tests := []struct {
 		name string
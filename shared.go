@@ -0,0 +1,109 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the SharedEngine type, which allows many goroutines to use the same
+// Tnt2Engine.
+
+import (
+	"math/big"
+	"sync"
+)
+
+// SharedEngine serializes access to a Tnt2Engine so that it can be used by many
+// goroutines at the same time.  Each call to Encrypt reserves the next
+// contiguous range of blocks for the whole message, so no two messages are ever
+// encrypted using the same block numbers.
+type SharedEngine struct {
+	mu   sync.Mutex
+	e    *Tnt2Engine
+	next *big.Int // The first block of the next range to be reserved.
+}
+
+// NewSharedEngine returns a SharedEngine that uses e, which must have been
+// initialized and not have a cipher machine running.  The first message is
+// encrypted starting at e.Index().  The SharedEngine takes ownership of e, which
+// should no longer be used directly.
+func NewSharedEngine(e *Tnt2Engine) *SharedEngine {
+	s := new(SharedEngine)
+	s.e = e
+	s.next = new(big.Int)
+	if idx := e.Index(); idx != nil {
+		s.next.Set(idx)
+	}
+	return s
+}
+
+// Index returns the block number that the next message will be encrypted at.
+func (s *SharedEngine) Index() *big.Int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return new(big.Int).Set(s.next)
+}
+
+// Encrypt encrypts plaintext as a single message, returning the ciphertext
+// and the block number the message was encrypted at.  The block number is
+// needed to decrypt the ciphertext.
+func (s *SharedEngine) Encrypt(plaintext []byte) (ciphertext []byte, start *big.Int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start = new(big.Int).Set(s.next)
+	ciphertext, err = s.run("E", plaintext, start)
+	if err != nil {
+		return nil, nil, err
+	}
+	blocks := (len(plaintext) + CipherBlockBytes - 1) / CipherBlockBytes
+	s.next.Add(s.next, big.NewInt(int64(blocks)))
+	return ciphertext, start, nil
+}
+
+// Decrypt decrypts ciphertext that was encrypted at the block number start.
+// It does not change the block number of the next message to be encrypted.
+func (s *SharedEngine) Decrypt(ciphertext []byte, start *big.Int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.run("D", ciphertext, start)
+}
+
+// run positions the engine at start and passes data through a cipher machine
+// of the given engineType.  The engine is positioned by SetIndex for each
+// message, since the permutators do not step on a short final block and would
+// otherwise be out of step with the rotors for the next message.
+func (s *SharedEngine) run(engineType string, data []byte, start *big.Int) ([]byte, error) {
+	s.e.SetIndex(start)
+	return runMachine(s.e, engineType, data)
+}
+
+// runMachine builds a cipher machine of the given engineType for e, passes
+// data through it, and closes it.
+func runMachine(e Engine, engineType string, data []byte) ([]byte, error) {
+	e.SetEngineType(engineType)
+	if err := e.BuildCipherMachine(); err != nil {
+		return nil, err
+	}
+	res := cryptBlocks(e.Left(), e.Right(), data)
+	return res, e.CloseCipherMachine()
+}
+
+// cryptBlocks sends data through the cipher machine with the given left and
+// right channels, one CipherBlock at a time, and returns the result.  The
+// blocks are sent from a separate goroutine so that the machine can hold a
+// block in each of its stages.
+func cryptBlocks(left, right chan CipherBlock, data []byte) []byte {
+	res := make([]byte, len(data))
+	copy(res, data)
+	go func() {
+		for off := 0; off < len(res); off += CipherBlockBytes {
+			end := off + CipherBlockBytes
+			if end > len(res) {
+				end = len(res)
+			}
+			left <- CipherBlock(res[off:end:end])
+		}
+	}()
+	for off := 0; off < len(res); off += CipherBlockBytes {
+		copy(res[off:], <-right)
+	}
+	return res
+}
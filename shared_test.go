@@ -0,0 +1,152 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"bytes"
+	"math/big"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestSharedEngine_Encrypt(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	tnt2Machine.SetIndex(big.NewInt(10))
+	s := NewSharedEngine(&tnt2Machine)
+	tests := []struct {
+		name      string
+		plaintext []byte
+		wantStart int64
+	}{
+		{
+			name:      "tsee1",
+			plaintext: []byte("A short message."),
+			wantStart: 10,
+		},
+		{
+			name:      "tsee2",
+			plaintext: bytes.Repeat([]byte("0123456789"), 10),
+			wantStart: 11,
+		},
+		{
+			name:      "tsee3",
+			plaintext: []byte{},
+			wantStart: 15,
+		},
+		{
+			name:      "tsee4",
+			plaintext: make([]byte, CipherBlockBytes),
+			wantStart: 15,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := append([]byte(nil), tt.plaintext...)
+			ciphertext, start, err := s.Encrypt(tt.plaintext)
+			if err != nil {
+				t.Fatalf("SharedEngine.Encrypt() error = %v", err)
+			}
+			if start.Cmp(big.NewInt(tt.wantStart)) != 0 {
+				t.Errorf("SharedEngine.Encrypt() start = %s, want %d", start, tt.wantStart)
+			}
+			if !bytes.Equal(tt.plaintext, orig) {
+				t.Errorf("SharedEngine.Encrypt() modified the plaintext")
+			}
+			if len(ciphertext) != len(tt.plaintext) {
+				t.Fatalf("len(ciphertext) = %d, want %d", len(ciphertext), len(tt.plaintext))
+			}
+			if len(ciphertext) > 0 && bytes.Equal(ciphertext, tt.plaintext) {
+				t.Errorf("SharedEngine.Encrypt() did not change the plaintext")
+			}
+			plaintext, err := s.Decrypt(ciphertext, start)
+			if err != nil {
+				t.Fatalf("SharedEngine.Decrypt() error = %v", err)
+			}
+			if !bytes.Equal(plaintext, tt.plaintext) {
+				t.Errorf("SharedEngine.Decrypt() = %q, want %q", plaintext, tt.plaintext)
+			}
+		})
+	}
+	if got := s.Index(); got.Cmp(big.NewInt(16)) != 0 {
+		t.Errorf("SharedEngine.Index() = %s, want 16", got)
+	}
+}
+
+func TestSharedEngine_Uninitialized(t *testing.T) {
+	s := NewSharedEngine(new(Tnt2Engine))
+	if _, _, err := s.Encrypt([]byte("data")); err != ErrNotInitialized {
+		t.Errorf("SharedEngine.Encrypt() error = %v, want %v", err, ErrNotInitialized)
+	}
+}
+
+// TestSharedEngine_Stress encrypts messages from many goroutines at once and
+// checks that the reserved block ranges are contiguous and do not overlap, and
+// that each ciphertext is the same as encrypting the message on its own.  Run
+// it with -race to check the SharedEngine for data races.
+func TestSharedEngine_Stress(t *testing.T) {
+	const goroutines, messages = 8, 25
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	s := NewSharedEngine(&tnt2Machine)
+	type result struct {
+		plaintext, ciphertext []byte
+		start                 *big.Int
+	}
+	results := make([][]result, goroutines)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for m := 0; m < messages; m++ {
+				plaintext := make([]byte, rnd.Intn(5*CipherBlockBytes))
+				rnd.Read(plaintext)
+				ciphertext, start, err := s.Encrypt(plaintext)
+				if err != nil {
+					t.Errorf("SharedEngine.Encrypt() error = %v", err)
+					return
+				}
+				results[g] = append(results[g], result{plaintext, ciphertext, start})
+			}
+		}(g)
+	}
+	wg.Wait()
+	var all []result
+	for _, r := range results {
+		all = append(all, r...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if c := all[i].start.Cmp(all[j].start); c != 0 {
+			return c < 0
+		}
+		return len(all[i].plaintext) < len(all[j].plaintext)
+	})
+	next := new(big.Int)
+	for _, r := range all {
+		if r.start.Cmp(next) != 0 {
+			t.Fatalf("message encrypted at block %s, want %s", r.start, next)
+		}
+		next.Add(next, big.NewInt(int64((len(r.plaintext)+CipherBlockBytes-1)/CipherBlockBytes)))
+	}
+	if got := s.Index(); got.Cmp(next) != 0 {
+		t.Errorf("SharedEngine.Index() = %s, want %s", got, next)
+	}
+	// Check the results using a separate engine, one message at a time.
+	var check Tnt2Engine
+	check.Init([]byte("SecretKey"), "")
+	c := NewSharedEngine(&check)
+	for _, r := range all {
+		plaintext, err := c.Decrypt(r.ciphertext, r.start)
+		if err != nil {
+			t.Fatalf("SharedEngine.Decrypt() error = %v", err)
+		}
+		if !bytes.Equal(plaintext, r.plaintext) {
+			t.Fatalf("message at block %s did not decrypt correctly", r.start)
+		}
+	}
+}
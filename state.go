@@ -0,0 +1,182 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the states of the Tnt2Engine and the starting and stopping of its
+// cipher machines.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+// EngineState is the state of a Tnt2Engine.
+type EngineState int
+
+const (
+	Uninitialized EngineState = iota // Init has not been called.
+	Ready                            // Init has been called and no cipher machine is running.
+	Running                          // A cipher machine (per-block or batched) is running.
+	Closed                           // Close has been called.
+)
+
+var engineStateNames = [...]string{"Uninitialized", "Ready", "Running", "Closed"}
+
+// String returns the name of the state.
+func (s EngineState) String() string {
+	if s >= 0 && int(s) < len(engineStateNames) {
+		return engineStateNames[s]
+	}
+	return fmt.Sprintf("EngineState(%d)", int(s))
+}
+
+// Errors returned when the cipher machines are built or closed in the wrong
+// state.
+var (
+	ErrNotInitialized = errors.New("tnt2engine: the engine has not been initialized")
+	ErrAlreadyRunning = errors.New("tnt2engine: a cipher machine is already running")
+	ErrNotRunning     = errors.New("tnt2engine: the cipher machine is not running")
+	ErrEngineClosed   = errors.New("tnt2engine: the engine is closed")
+)
+
+// State is a getter function that returns the current state of the engine.  A
+// cipher machine whose stages have all exited (because its context was
+// cancelled or a zero length block was sent to it directly) is no longer
+// Running, so the engine is Ready again.  A machine cancelled part way through
+// a block may have stepped some of the rotors and permutators for that block,
+// so they are first positioned back at the block number of the counter.
+func (e *Tnt2Engine) State() EngineState {
+	if e.state == Running && e.stopped() {
+		e.cancel()
+		e.resync()
+		e.state = Ready
+	}
+	return e.state
+}
+
+// resync positions each rotor and permutator at the block number of the
+// counter that follows it, which is the number of blocks that have passed
+// through the whole machine.  (A Cascade has one counter for each engine.)
+func (e *Tnt2Engine) resync() {
+	var index *big.Int
+	for idx := len(e.engine) - 1; idx >= 0; idx-- {
+		machine := e.engine[idx]
+		if cntr, ok := machine.(*Counter); ok {
+			index = cntr.Index()
+			continue
+		}
+		if index == nil {
+			continue
+		}
+		if m, ok := machine.(uint64Indexer); ok && index.IsUint64() {
+			m.SetIndexUint64(index.Uint64())
+		} else {
+			machine.SetIndex(new(big.Int).Set(index))
+		}
+	}
+}
+
+// Done returns a channel that is closed when all of the stages of the most
+// recently built cipher machine have exited.  Code sending blocks to the
+// machine can select on it to avoid blocking after the machine has stopped.
+// It returns nil if no cipher machine has been built.
+func (e *Tnt2Engine) Done() <-chan struct{} {
+	return e.done
+}
+
+// Close shuts down any running cipher machine and moves the engine to the
+// Closed state.  No cipher machine can be built until Init is called again.
+// Calling Close more than once is safe.
+func (e *Tnt2Engine) Close() error {
+	if e.State() == Running {
+		e.stopMachine()
+	}
+	e.state = Closed
+	return nil
+}
+
+// stopped returns true if all of the stages of the cipher machine have exited.
+func (e *Tnt2Engine) stopped() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkStart returns an error if a cipher machine can not be built in the
+// current state of the engine.
+func (e *Tnt2Engine) checkStart() error {
+	switch e.State() {
+	case Uninitialized:
+		return ErrNotInitialized
+	case Running:
+		return ErrAlreadyRunning
+	case Closed:
+		return ErrEngineClosed
+	}
+	return nil
+}
+
+// startMachine builds the per-block (or batched) encrypt (or decrypt) machine.
+// The stages of the machine exit when ctx is cancelled, after which the Done
+// channel is closed.
+func (e *Tnt2Engine) startMachine(ctx context.Context, batch, decrypt bool) {
+	ctx, e.cancel = context.WithCancel(ctx)
+	wg := new(sync.WaitGroup)
+	if batch {
+		e.batchLeft, e.batchRight = createBatchMachine(ctx, wg, e.pipelineDepth, decrypt, e.engine...)
+	} else {
+		e.left, e.right = createCipherMachine(ctx, wg, decrypt, e.engine...)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	e.done = done
+	e.batchRunning = batch
+	e.state = Running
+}
+
+// stopMachine shuts down the running cipher machine.  It passes a zero length
+// block (or batch) through the machine, discarding anything still in it, then
+// cancels the context of the machine and waits for all of its stages to exit.
+// Stages that have already exited are not waited on.
+func (e *Tnt2Engine) stopMachine() {
+	if e.batchRunning {
+		select {
+		case e.batchLeft <- CipherBatch{}:
+			for drain := true; drain; {
+				select {
+				case batch, ok := <-e.batchRight:
+					drain = ok && len(batch) != 0
+				case <-e.done:
+					drain = false
+				}
+			}
+		case <-e.done:
+		}
+	} else {
+		select {
+		case e.left <- CipherBlock{}:
+			for drain := true; drain; {
+				select {
+				case blk, ok := <-e.right:
+					drain = ok && len(blk) != 0
+				case <-e.done:
+					drain = false
+				}
+			}
+		case <-e.done:
+		}
+	}
+	e.cancel()
+	<-e.done
+	e.state = Ready
+}
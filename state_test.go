@@ -0,0 +1,204 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// waitForGoroutines waits for the number of goroutines to drop to n, failing
+// the test if it does not do so within a few seconds.
+func waitForGoroutines(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines are running, want %d", runtime.NumGoroutine(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEngineState_String(t *testing.T) {
+	tests := []struct {
+		s    EngineState
+		want string
+	}{
+		{Uninitialized, "Uninitialized"},
+		{Ready, "Ready"},
+		{Running, "Running"},
+		{Closed, "Closed"},
+		{EngineState(9), "EngineState(9)"},
+	}
+	for _, tt := range tests {
+		if got := tt.s.String(); got != tt.want {
+			t.Errorf("EngineState.String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestTnt2Engine_State(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.SetEngineType("E")
+	if got := tnt2Machine.State(); got != Uninitialized {
+		t.Errorf("State() = %v, want %v", got, Uninitialized)
+	}
+	if err := tnt2Machine.BuildCipherMachine(); err != ErrNotInitialized {
+		t.Errorf("BuildCipherMachine() before Init = %v, want %v", err, ErrNotInitialized)
+	}
+	if err := tnt2Machine.CloseCipherMachine(); err != ErrNotRunning {
+		t.Errorf("CloseCipherMachine() before Init = %v, want %v", err, ErrNotRunning)
+	}
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	if got := tnt2Machine.State(); got != Ready {
+		t.Errorf("State() after Init = %v, want %v", got, Ready)
+	}
+	if err := tnt2Machine.BuildCipherMachine(); err != nil {
+		t.Fatalf("BuildCipherMachine() = %v", err)
+	}
+	if got := tnt2Machine.State(); got != Running {
+		t.Errorf("State() after BuildCipherMachine = %v, want %v", got, Running)
+	}
+	if err := tnt2Machine.BuildCipherMachine(); err != ErrAlreadyRunning {
+		t.Errorf("second BuildCipherMachine() = %v, want %v", err, ErrAlreadyRunning)
+	}
+	if err := tnt2Machine.BuildBatchCipherMachine(); err != ErrAlreadyRunning {
+		t.Errorf("BuildBatchCipherMachine() while running = %v, want %v", err, ErrAlreadyRunning)
+	}
+	if err := tnt2Machine.CloseBatchCipherMachine(); err != ErrNotRunning {
+		t.Errorf("CloseBatchCipherMachine() = %v, want %v", err, ErrNotRunning)
+	}
+	if err := tnt2Machine.CloseCipherMachine(); err != nil {
+		t.Errorf("CloseCipherMachine() = %v", err)
+	}
+	if err := tnt2Machine.CloseCipherMachine(); err != ErrNotRunning {
+		t.Errorf("second CloseCipherMachine() = %v, want %v", err, ErrNotRunning)
+	}
+	if got := tnt2Machine.State(); got != Ready {
+		t.Errorf("State() after CloseCipherMachine = %v, want %v", got, Ready)
+	}
+	for i := 0; i < 2; i++ {
+		if err := tnt2Machine.Close(); err != nil {
+			t.Errorf("Close() = %v", err)
+		}
+		if got := tnt2Machine.State(); got != Closed {
+			t.Errorf("State() after Close = %v, want %v", got, Closed)
+		}
+	}
+	if err := tnt2Machine.BuildCipherMachine(); err != ErrEngineClosed {
+		t.Errorf("BuildCipherMachine() after Close = %v, want %v", err, ErrEngineClosed)
+	}
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	if got := tnt2Machine.State(); got != Ready {
+		t.Errorf("State() after re-Init = %v, want %v", got, Ready)
+	}
+}
+
+func TestTnt2Engine_CloseRunning(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	tnt2Machine.SetEngineType("E")
+	base := runtime.NumGoroutine()
+	// Close stops a running machine that still has a block in it.
+	tnt2Machine.BuildCipherMachine()
+	left, done := tnt2Machine.Left(), tnt2Machine.Done()
+	go func() {
+		select {
+		case left <- make(CipherBlock, CipherBlockBytes):
+		case <-done:
+		}
+	}()
+	if err := tnt2Machine.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	waitForGoroutines(t, base)
+	// Init stops a running batched machine.
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	tnt2Machine.BuildBatchCipherMachine()
+	tnt2Machine.BatchLeft() <- CipherBatch{make(CipherBlock, CipherBlockBytes)}
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	if got := tnt2Machine.State(); got != Ready {
+		t.Errorf("State() after Init = %v, want %v", got, Ready)
+	}
+	waitForGoroutines(t, base)
+}
+
+func TestTnt2Engine_BuildCipherMachineContext(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	tnt2Machine.SetEngineType("E")
+	tnt2Machine.SetIndex(BigZero)
+	base := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := tnt2Machine.BuildCipherMachineContext(ctx); err != nil {
+		t.Fatalf("BuildCipherMachineContext() = %v", err)
+	}
+	tnt2Machine.Left() <- make(CipherBlock, CipherBlockBytes)
+	if blk := <-tnt2Machine.Right(); len(blk) != CipherBlockBytes {
+		t.Fatalf("len(<-Right()) = %d, want %d", len(blk), CipherBlockBytes)
+	}
+	// Leave a block in the machine, then cancel the context.
+	tnt2Machine.Left() <- make(CipherBlock, CipherBlockBytes)
+	cancel()
+	select {
+	case <-tnt2Machine.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cipher machine did not stop when its context was cancelled")
+	}
+	for range tnt2Machine.Right() {
+	}
+	if got := tnt2Machine.State(); got != Ready {
+		t.Errorf("State() after cancel = %v, want %v", got, Ready)
+	}
+	if err := tnt2Machine.CloseCipherMachine(); err != ErrNotRunning {
+		t.Errorf("CloseCipherMachine() after cancel = %v, want %v", err, ErrNotRunning)
+	}
+	waitForGoroutines(t, base)
+	// The rotors and permutators that stepped for the block left in the
+	// machine are positioned back at the block number of the counter.
+	var ref Tnt2Engine
+	ref.Init([]byte("SecretKey"), "")
+	ref.SetIndex(tnt2Machine.Index())
+	plaintext := bytes.Repeat([]byte("0123456789"), 10)
+	want, _ := runMachine(&ref, "E", plaintext)
+	if got, err := runMachine(&tnt2Machine, "E", plaintext); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("the engine does not encrypt from Index() after cancel: %v", err)
+	}
+	// The engine can be used again after the context is cancelled.
+	if err := tnt2Machine.BuildCipherMachine(); err != nil {
+		t.Fatalf("BuildCipherMachine() after cancel = %v", err)
+	}
+	if err := tnt2Machine.CloseCipherMachine(); err != nil {
+		t.Errorf("CloseCipherMachine() = %v", err)
+	}
+	waitForGoroutines(t, base)
+}
+
+func TestTnt2Engine_BuildBatchCipherMachineContext(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	tnt2Machine.SetEngineType("D")
+	base := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := tnt2Machine.BuildBatchCipherMachineContext(ctx); err != nil {
+		t.Fatalf("BuildBatchCipherMachineContext() = %v", err)
+	}
+	for i := 0; i < tnt2Machine.PipelineDepth(); i++ {
+		tnt2Machine.BatchLeft() <- CipherBatch{make(CipherBlock, CipherBlockBytes)}
+	}
+	cancel()
+	select {
+	case <-tnt2Machine.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the batched cipher machine did not stop when its context was cancelled")
+	}
+	if got := tnt2Machine.State(); got != Ready {
+		t.Errorf("State() after cancel = %v, want %v", got, Ready)
+	}
+	waitForGoroutines(t, base)
+}
@@ -0,0 +1,561 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the chunked stream format, where each chunk of the stream carries its
+// own authentication tag so that plaintext can be released as soon as the
+// chunk containing it has been checked.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"math/big"
+)
+
+// The stream starts with a header:
+//
+//	magic      [4]byte  "TNT2"
+//	version    byte     StreamVersion
+//	flags      byte     bits 0-1 hold the TailMode, bit 2 marks a padded
+//	                    length, bit 3 marks a key check value, bit 4 marks
+//	                    a configuration fingerprint, the rest must be 0
+//	chunkSize  uint32   big-endian, a multiple of CipherBlockBytes
+//	keyCheck   [4]byte  the KeyCheck of the engine, if bit 3 of flags is set
+//	config     [32]byte the ConfigFingerprint of the engine, if bit 4 of
+//	                    flags is set
+//	startLen   byte     the length of start
+//	start      []byte   big-endian block number of the first chunk
+//
+// followed by the chunks.  Chunk i holds the next chunkSize bytes of the
+// message encrypted starting at block start + i*chunkSize/CipherBlockBytes,
+// followed by a tag of StreamTagSize bytes.  The last chunk holds the rest of
+// the message, encrypted using the tail mode, so it may be shorter than
+// chunkSize (or empty) and, with TailSteal or TailPad, longer by up to
+// CipherBlockBytes.  The tag is an HMAC-SHA256, keyed by a key derived from
+// the secret state of the engine, over the header, the chunk number, flags
+// marking the last chunk and a padded chunk, and the ciphertext of the chunk.
+// Binding the chunk number and the last chunk flag into the tag (as the STREAM
+// construction does) detects chunks that were reordered, dropped, or appended,
+// and a stream truncated at a chunk boundary.
+//
+// When the length of the stream is padded, the plaintext of each chunk starts
+// with a big-endian uint32 holding how many of the bytes following it are part
+// of the message; the rest are padding.  The padding is at the end of the
+// message, so it may fill several chunks.
+const (
+	StreamVersion    byte = 1
+	StreamTagSize    int  = sha256.Size
+	DefaultChunkSize int  = 64 * 1024
+	// MaxChunkSize limits the memory a reader allocates for a chunk.
+	MaxChunkSize int = 16 * 1024 * 1024
+)
+
+var streamMagic = [4]byte{'T', 'N', 'T', '2'}
+
+// Errors returned by the StreamWriter and StreamReader.
+var (
+	ErrStreamHeader    = errors.New("tnt2engine: invalid stream header")
+	ErrStreamAuth      = errors.New("tnt2engine: stream chunk failed authentication")
+	ErrStreamTruncated = errors.New("tnt2engine: stream is truncated")
+	ErrStreamClosed    = errors.New("tnt2engine: write to a closed stream")
+	ErrWrongKey        = errors.New("tnt2engine: the ciphertext was encrypted with a different key")
+	ErrConfigMismatch  = errors.New("tnt2engine: the ciphertext was encrypted with a different engine configuration")
+	errChunkSize       = errors.New("tnt2engine: the chunk size must be a positive multiple of CipherBlockBytes")
+	errTailMode        = errors.New("tnt2engine: unknown tail mode")
+)
+
+// The flags in the stream header.
+const (
+	flagsTailMode byte = 0x03 // The TailMode used for the last chunk.
+	flagsPadded   byte = 0x04 // The chunks start with the length of their data.
+	flagsKeyCheck byte = 0x08 // The header holds the key check value.
+	flagsConfig   byte = 0x10 // The header holds the configuration fingerprint.
+	flagsTailPad  byte = 0x20 // The last (TailSteal) chunk was padded to a full block.
+	flagsAll           = flagsTailMode | flagsPadded | flagsKeyCheck | flagsConfig | flagsTailPad
+)
+
+// chunkLenSize is the size of the length at the start of each chunk of a
+// stream with a padded length.
+const chunkLenSize = 4
+
+// StreamOptions holds the options used by a StreamWriter.
+type StreamOptions struct {
+	ChunkSize int      // The size of a chunk in bytes.
+	Tail      TailMode // How the end of the stream is encrypted.
+	// Padding, if not nil, pads the length of the stream to hide the
+	// length of the message.
+	Padding PadPolicy
+}
+
+// StreamHeader holds the values in the header of a stream.
+type StreamHeader struct {
+	Version   byte     // The version of the stream format.
+	Flags     byte     // Options used to encrypt the stream.
+	ChunkSize int      // The size of the plaintext in each full chunk.
+	Start     *big.Int // The block number of the start of the first chunk.
+	KeyCheck  []byte   // The key check value of the engine, if any.
+	Config    []byte   // The configuration fingerprint of the engine, if any.
+}
+
+// marshal returns the header encoded as it appears at the start of a stream.
+func (h *StreamHeader) marshal() []byte {
+	start := h.Start.Bytes()
+	buf := make([]byte, 0, 11+len(h.KeyCheck)+len(h.Config)+len(start))
+	buf = append(buf, streamMagic[:]...)
+	buf = append(buf, h.Version, h.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(h.ChunkSize))
+	if h.Flags&flagsKeyCheck != 0 {
+		buf = append(buf, h.KeyCheck...)
+	}
+	if h.Flags&flagsConfig != 0 {
+		buf = append(buf, h.Config...)
+	}
+	buf = append(buf, byte(len(start)))
+	return append(buf, start...)
+}
+
+// Tail returns the tail mode used to encrypt the end of the stream.
+func (h *StreamHeader) Tail() TailMode {
+	return TailMode(h.Flags & flagsTailMode)
+}
+
+// Padded reports whether the length of the stream is padded.
+func (h *StreamHeader) Padded() bool {
+	return h.Flags&flagsPadded != 0
+}
+
+// chunkData returns the number of bytes of the message held in a full chunk.
+func (h *StreamHeader) chunkData() int {
+	if h.Padded() {
+		return h.ChunkSize - chunkLenSize
+	}
+	return h.ChunkSize
+}
+
+// readStreamHeader reads and checks the header at the start of a stream,
+// returning the header and its encoding.
+func readStreamHeader(r io.Reader) (*StreamHeader, []byte, error) {
+	var encoded []byte
+	// read returns the next n bytes of the header.
+	read := func(n int) ([]byte, error) {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, ErrStreamHeader
+		}
+		encoded = append(encoded, buf...)
+		return buf, nil
+	}
+	buf, err := read(10)
+	if err != nil {
+		return nil, nil, err
+	}
+	if [4]byte(buf[:4]) != streamMagic || buf[4] != StreamVersion || buf[5]&^flagsAll != 0 {
+		return nil, nil, ErrStreamHeader
+	}
+	h := new(StreamHeader)
+	h.Version, h.Flags = buf[4], buf[5]
+	h.ChunkSize = int(binary.BigEndian.Uint32(buf[6:]))
+	if checkChunkSize(h.ChunkSize) != nil || h.Tail() > TailPad || (h.Flags&flagsTailPad != 0 && h.Tail() != TailSteal) {
+		return nil, nil, ErrStreamHeader
+	}
+	if h.Flags&flagsKeyCheck != 0 {
+		if h.KeyCheck, err = read(KeyCheckSize); err != nil {
+			return nil, nil, err
+		}
+	}
+	if h.Flags&flagsConfig != 0 {
+		if h.Config, err = read(ConfigFingerprintSize); err != nil {
+			return nil, nil, err
+		}
+	}
+	if buf, err = read(1); err != nil {
+		return nil, nil, err
+	}
+	start, err := read(int(buf[0]))
+	if err != nil {
+		return nil, nil, err
+	}
+	h.Start = new(big.Int).SetBytes(start)
+	return h, encoded, nil
+}
+
+// checkChunkSize returns an error if chunkSize can not be used for a stream.
+func checkChunkSize(chunkSize int) error {
+	if chunkSize <= 0 || chunkSize > MaxChunkSize || chunkSize%CipherBlockBytes != 0 {
+		return errChunkSize
+	}
+	return nil
+}
+
+// streamMAC computes the tags of the chunks of a stream.
+type streamMAC struct {
+	mac    hash.Hash
+	header []byte
+}
+
+// newStreamMAC returns a streamMAC for the stream with the encoded header using
+// a key derived from e.
+func newStreamMAC(e *Tnt2Engine, header []byte) *streamMAC {
+	return &streamMAC{hmac.New(sha256.New, e.deriveKey("stream chunk mac")), header}
+}
+
+// tag returns the tag of chunk number chunk.
+func (m *streamMAC) tag(chunk uint64, last, padded bool, ciphertext []byte) []byte {
+	var buf [9]byte
+	binary.BigEndian.PutUint64(buf[:], chunk)
+	if last {
+		buf[8] |= 1
+	}
+	if padded {
+		buf[8] |= 2
+	}
+	m.mac.Reset()
+	m.mac.Write(m.header)
+	m.mac.Write(buf[:])
+	m.mac.Write(ciphertext)
+	return m.mac.Sum(nil)
+}
+
+// chunkIndex returns the block number of the start of chunk number chunk.
+func chunkIndex(h *StreamHeader, chunk uint64) *big.Int {
+	idx := new(big.Int).SetUint64(chunk)
+	idx.Mul(idx, big.NewInt(int64(h.ChunkSize/CipherBlockBytes)))
+	return idx.Add(idx, h.Start)
+}
+
+// tailExtra returns how many bytes longer than the chunk size the ciphertext of
+// the last chunk can be with the given tail mode.
+func tailExtra(mode TailMode) int {
+	switch mode {
+	case TailSteal:
+		return CipherBlockBytes - 1
+	case TailPad:
+		return CipherBlockBytes
+	}
+	return 0
+}
+
+// StreamWriter encrypts the data written to it into the chunked stream
+// format.  Close must be called to write the last chunk.
+type StreamWriter struct {
+	w      io.Writer
+	e      *Tnt2Engine
+	header *StreamHeader
+	mac    *streamMAC
+	buf    []byte // The plaintext of the current chunk.
+	chunk  uint64
+	pad    PadPolicy
+	size   int64 // The number of bytes of the message written.
+	sent   int64 // The number of bytes (data or padding) in the written chunks.
+	closed bool
+	err    error
+}
+
+// NewStreamWriter returns a StreamWriter that writes a stream to w, encrypting
+// using e, starting at e.Index().  The header is written with the first chunk,
+// once it is known whether a TailSteal stream shorter than a block is padded.  The chunkSize (in bytes) must be a
+// multiple of CipherBlockBytes.  After Close, e.Index() is the block number
+// following the last block of the stream.  The end of the stream is encrypted
+// with TailPlain.
+func NewStreamWriter(w io.Writer, e *Tnt2Engine, chunkSize int) (*StreamWriter, error) {
+	return NewStreamWriterOptions(w, e, StreamOptions{ChunkSize: chunkSize, Tail: TailPlain})
+}
+
+// NewStreamWriterOptions is like NewStreamWriter, using the given options.  The
+// tail mode and whether the length is padded are recorded in the header, so a
+// StreamReader decrypts the stream without being told the options.
+func NewStreamWriterOptions(w io.Writer, e *Tnt2Engine, opts StreamOptions) (*StreamWriter, error) {
+	if err := checkChunkSize(opts.ChunkSize); err != nil {
+		return nil, err
+	}
+	if opts.Tail > TailPad {
+		return nil, errTailMode
+	}
+	sw := new(StreamWriter)
+	sw.w = w
+	sw.e = e
+	flags := byte(opts.Tail) | flagsKeyCheck | flagsConfig
+	if opts.Padding != nil {
+		flags |= flagsPadded
+	}
+	sw.header = &StreamHeader{StreamVersion, flags, opts.ChunkSize, new(big.Int).Set(e.Index()), e.KeyCheck(), e.ConfigFingerprint()}
+	sw.pad = opts.Padding
+	// With TailSteal, the bytes that would make a short last chunk are kept
+	// with the chunk before it, so there is a full block to steal from.
+	extra := 0
+	if opts.Tail == TailSteal {
+		extra = CipherBlockBytes - 1
+	}
+	sw.buf = make([]byte, 0, sw.header.chunkData()+extra)
+	return sw, nil
+}
+
+// writeHeader writes the header of the stream, noting whether the first chunk,
+// of n bytes, is padded, and sets up the MAC of the chunks.
+func (sw *StreamWriter) writeHeader(last bool, n int) error {
+	if last && sw.header.Tail() == TailSteal && tailPadded(TailSteal, n) {
+		sw.header.Flags |= flagsTailPad
+	}
+	header := sw.header.marshal()
+	sw.mac = newStreamMAC(sw.e, header)
+	_, err := sw.w.Write(header)
+	return err
+}
+
+// Header returns the header of the stream.  Its flags are only complete once
+// the first chunk has been written.
+func (sw *StreamWriter) Header() StreamHeader {
+	return *sw.header
+}
+
+// Write encrypts p into the stream.  A chunk is written once it is full and
+// more data is written, since only then is it known not to be the last chunk.
+func (sw *StreamWriter) Write(p []byte) (n int, err error) {
+	if sw.closed {
+		return 0, ErrStreamClosed
+	}
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	// The size must include all of p before any of it is flushed, since
+	// the length at the start of a chunk counts the data that follows.
+	sw.size += int64(len(p))
+	n, err = sw.write(p)
+	sw.size -= int64(len(p) - n)
+	return n, err
+}
+
+// write adds p, which is either message data or padding, to the stream.
+func (sw *StreamWriter) write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if len(sw.buf) == cap(sw.buf) {
+			if err = sw.flush(false); err != nil {
+				return n, err
+			}
+		}
+		cnt := copy(sw.buf[len(sw.buf):cap(sw.buf)], p)
+		sw.buf = sw.buf[:len(sw.buf)+cnt]
+		p = p[cnt:]
+		n += cnt
+	}
+	return n, nil
+}
+
+// Close writes the last chunk of the stream.  It does not close the
+// underlying io.Writer.  Calling Close more than once is safe.
+func (sw *StreamWriter) Close() error {
+	if sw.closed {
+		return sw.err
+	}
+	sw.closed = true
+	if sw.err == nil && sw.pad != nil {
+		sw.err = sw.writePadding()
+	}
+	if sw.err == nil {
+		sw.err = sw.flush(true)
+	}
+	return sw.err
+}
+
+// writePadding adds the padding chosen by the pad policy to the end of the
+// stream.
+func (sw *StreamWriter) writePadding() error {
+	var fill int64
+	if p, ok := sw.pad.(EnginePadPolicy); ok {
+		fill = p.PaddedSizeFor(sw.e, sw.header.marshal(), sw.size) - sw.size
+	} else {
+		fill = sw.pad.PaddedSize(sw.size) - sw.size
+	}
+	zeros := make([]byte, sw.header.ChunkSize)
+	for fill > 0 {
+		n := int64(len(zeros))
+		if n > fill {
+			n = fill
+		}
+		if _, err := sw.write(zeros[:n]); err != nil {
+			return err
+		}
+		fill -= n
+	}
+	return nil
+}
+
+// flush encrypts and writes the next chunk.  The last chunk is all of the
+// buffered data, encrypted using the tail mode; any other chunk is the first
+// ChunkSize bytes of it.
+func (sw *StreamWriter) flush(last bool) error {
+	var ciphertext []byte
+	var padded bool
+	var err error
+	data := sw.buf
+	if !last {
+		data = sw.buf[:sw.header.chunkData()]
+	}
+	plaintext := data
+	if sw.header.Padded() {
+		// Only the bytes before the padding are part of the message.
+		msgLen := sw.size - sw.sent
+		if msgLen > int64(len(data)) {
+			msgLen = int64(len(data))
+		} else if msgLen < 0 {
+			msgLen = 0
+		}
+		plaintext = binary.BigEndian.AppendUint32(make([]byte, 0, chunkLenSize+len(data)), uint32(msgLen))
+		plaintext = append(plaintext, data...)
+	}
+	if sw.chunk == 0 {
+		if err = sw.writeHeader(last, len(plaintext)); err != nil {
+			sw.err = err
+			return err
+		}
+	}
+	start := chunkIndex(sw.header, sw.chunk)
+	if last {
+		ciphertext, padded, err = encryptTail(sw.e, sw.header.Tail(), plaintext, start)
+	} else {
+		sw.e.SetIndex(start)
+		ciphertext, err = runMachine(sw.e, "E", plaintext)
+	}
+	if err == nil {
+		ciphertext = append(ciphertext, sw.mac.tag(sw.chunk, last, padded, ciphertext)...)
+		_, err = sw.w.Write(ciphertext)
+	}
+	if err != nil {
+		sw.err = err
+		return err
+	}
+	sw.chunk++
+	sw.sent += int64(len(data))
+	sw.buf = sw.buf[:copy(sw.buf, sw.buf[len(data):])]
+	return nil
+}
+
+// StreamReader decrypts a stream written by a StreamWriter.  The plaintext of
+// each chunk is only returned after the tag of the chunk has been checked.
+type StreamReader struct {
+	r      *bufio.Reader
+	e      *Tnt2Engine
+	header *StreamHeader
+	mac    *streamMAC
+	limit  int    // The largest size of the last chunk, with its tag.
+	plain  []byte // Plaintext that has not been read yet.
+	chunk  uint64
+	size   int64 // The size of the data, with any padding, in the chunks read.
+	done   bool  // The last chunk has been read.
+	err    error
+}
+
+// NewStreamReader reads the stream header from r and returns a StreamReader
+// that decrypts the stream using e.  It returns ErrConfigMismatch if the
+// configuration fingerprint in the header is not the ConfigFingerprint of e,
+// and ErrWrongKey if the key check value in the header is not the KeyCheck
+// of e.
+func NewStreamReader(r io.Reader, e *Tnt2Engine) (*StreamReader, error) {
+	sr := new(StreamReader)
+	sr.e = e
+	header, encoded, err := readStreamHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if header.Config != nil && !bytes.Equal(header.Config, e.ConfigFingerprint()) {
+		return nil, ErrConfigMismatch
+	}
+	if header.KeyCheck != nil && !bytes.Equal(header.KeyCheck, e.KeyCheck()) {
+		return nil, ErrWrongKey
+	}
+	sr.header = header
+	sr.mac = newStreamMAC(e, encoded)
+	sr.limit = header.ChunkSize + tailExtra(header.Tail()) + StreamTagSize
+	// The reader must be able to look one byte past the largest last chunk
+	// to tell whether the chunk being read is the last one.
+	sr.r = bufio.NewReaderSize(r, sr.limit+1)
+	return sr, nil
+}
+
+// Header returns the header of the stream.
+func (sr *StreamReader) Header() StreamHeader {
+	return *sr.header
+}
+
+// Read reads decrypted plaintext into p.  It returns ErrStreamAuth if a chunk
+// has been changed, reordered, or added, and ErrStreamTruncated (or
+// ErrStreamAuth) if the stream ends before its last chunk.
+func (sr *StreamReader) Read(p []byte) (n int, err error) {
+	for len(sr.plain) == 0 {
+		if sr.err != nil {
+			return 0, sr.err
+		}
+		if sr.done {
+			return 0, io.EOF
+		}
+		sr.err = sr.readChunk()
+	}
+	n = copy(p, sr.plain)
+	sr.plain = sr.plain[n:]
+	return n, nil
+}
+
+// readChunk reads, checks, and decrypts the next chunk.  A chunk is the last
+// chunk if no more than the largest last chunk remains in the stream; any
+// other chunk holds ChunkSize bytes of ciphertext.
+func (sr *StreamReader) readChunk() error {
+	buf, err := sr.r.Peek(sr.limit + 1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	last := len(buf) <= sr.limit
+	if !last {
+		buf = buf[:sr.header.ChunkSize+StreamTagSize]
+	} else if len(buf) < StreamTagSize {
+		return ErrStreamTruncated
+	}
+	ciphertext, tag := buf[:len(buf)-StreamTagSize], buf[len(buf)-StreamTagSize:]
+	mode := sr.header.Tail()
+	padded := last && (mode == TailPad || sr.header.Flags&flagsTailPad != 0)
+	if !hmac.Equal(tag, sr.mac.tag(sr.chunk, last, padded, ciphertext)) {
+		return ErrStreamAuth
+	}
+	start := chunkIndex(sr.header, sr.chunk)
+	if last {
+		sr.plain, err = decryptTail(sr.e, mode, ciphertext, start, padded)
+	} else {
+		sr.e.SetIndex(start)
+		sr.plain, err = runMachine(sr.e, "D", ciphertext)
+	}
+	if err != nil {
+		return err
+	}
+	sr.size += int64(len(sr.plain))
+	if sr.header.Padded() {
+		sr.size -= chunkLenSize
+		if sr.plain, err = chunkMessage(sr.plain); err != nil {
+			return err
+		}
+	}
+	if _, err = sr.r.Discard(len(buf)); err != nil {
+		return err
+	}
+	sr.chunk++
+	sr.done = last
+	return nil
+}
+
+// chunkMessage returns the bytes of the message in the plaintext of a chunk of a
+// stream with a padded length.
+func chunkMessage(plaintext []byte) ([]byte, error) {
+	if len(plaintext) < chunkLenSize {
+		return nil, ErrPadding
+	}
+	msgLen := binary.BigEndian.Uint32(plaintext)
+	if uint64(msgLen) > uint64(len(plaintext)-chunkLenSize) {
+		return nil, ErrPadding
+	}
+	return plaintext[chunkLenSize : chunkLenSize+int(msgLen)], nil
+}
@@ -0,0 +1,367 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"bytes"
+	"io"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+// encryptStream encrypts plaintext into the stream format, writing it in
+// pieces of the given size.
+func encryptStream(t *testing.T, e *Tnt2Engine, plaintext []byte, chunkSize, pieceSize int) []byte {
+	t.Helper()
+	return encryptStreamOptions(t, e, plaintext, StreamOptions{ChunkSize: chunkSize}, pieceSize)
+}
+
+// encryptStreamOptions is like encryptStream, using the given options.
+func encryptStreamOptions(t *testing.T, e *Tnt2Engine, plaintext []byte, opts StreamOptions, pieceSize int) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	sw, err := NewStreamWriterOptions(&out, e, opts)
+	if err != nil {
+		t.Fatalf("NewStreamWriterOptions() error = %v", err)
+	}
+	for p := plaintext; len(p) > 0; {
+		n := pieceSize
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := sw.Write(p[:n]); err != nil {
+			t.Fatalf("StreamWriter.Write() error = %v", err)
+		}
+		p = p[n:]
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("StreamWriter.Close() error = %v", err)
+	}
+	return out.Bytes()
+}
+
+// decryptStream decrypts a stream, returning the plaintext read before any
+// error.
+func decryptStream(e *Tnt2Engine, stream []byte) ([]byte, error) {
+	sr, err := NewStreamReader(bytes.NewReader(stream), e)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(sr)
+}
+
+func TestStream_RoundTrip(t *testing.T) {
+	const chunkSize = 2 * 32
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	plaintext := make([]byte, 10*chunkSize+5)
+	rand.New(rand.NewSource(1)).Read(plaintext)
+	tests := []struct {
+		name      string
+		size      int
+		pieceSize int
+		wantTotal int // The size of the stream after the header.
+	}{
+		{name: "tsrt1", size: 0, pieceSize: 1, wantTotal: StreamTagSize},
+		{name: "tsrt2", size: 1, pieceSize: 1, wantTotal: 1 + StreamTagSize},
+		{name: "tsrt3", size: chunkSize - 1, pieceSize: 7, wantTotal: chunkSize - 1 + StreamTagSize},
+		{name: "tsrt4", size: chunkSize, pieceSize: chunkSize, wantTotal: chunkSize + StreamTagSize},
+		{name: "tsrt5", size: chunkSize + 1, pieceSize: 100, wantTotal: chunkSize + 1 + 2*StreamTagSize},
+		{name: "tsrt6", size: 3 * chunkSize, pieceSize: 1000, wantTotal: 3 * (chunkSize + StreamTagSize)},
+		{name: "tsrt7", size: len(plaintext), pieceSize: 33, wantTotal: len(plaintext) + 11*StreamTagSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := big.NewInt(1000)
+			tnt2Machine.SetIndex(start)
+			stream := encryptStream(t, &tnt2Machine, plaintext[:tt.size], chunkSize, tt.pieceSize)
+			wantNext := big.NewInt(int64(1000 + (tt.size+CipherBlockBytes-1)/CipherBlockBytes))
+			if tnt2Machine.Index().Cmp(wantNext) != 0 {
+				t.Errorf("Index() after Close = %s, want %s", tnt2Machine.Index(), wantNext)
+			}
+			header := (&StreamHeader{StreamVersion, flagsKeyCheck | flagsConfig, chunkSize, start, tnt2Machine.KeyCheck(), tnt2Machine.ConfigFingerprint()}).marshal()
+			if !bytes.Equal(stream[:len(header)], header) {
+				t.Fatalf("stream header = %x, want %x", stream[:len(header)], header)
+			}
+			if got := len(stream) - len(header); got != tt.wantTotal {
+				t.Errorf("len(stream) - len(header) = %d, want %d", got, tt.wantTotal)
+			}
+			// The chunks are contiguous block ranges, so without the tags the
+			// ciphertext is the message encrypted as a whole.
+			var ciphertext []byte
+			for body := stream[len(header):]; len(body) > 0; {
+				n := chunkSize
+				if n > len(body)-StreamTagSize {
+					n = len(body) - StreamTagSize
+				}
+				ciphertext = append(ciphertext, body[:n]...)
+				body = body[n+StreamTagSize:]
+			}
+			if want := encryptMessage(t, &tnt2Machine, plaintext[:tt.size], start); !bytes.Equal(ciphertext, want) {
+				t.Errorf("the chunk ciphertext is not the message encrypted as a whole")
+			}
+			got, err := decryptStream(&tnt2Machine, stream)
+			if err != nil {
+				t.Fatalf("decryptStream() error = %v", err)
+			}
+			if !bytes.Equal(got, plaintext[:tt.size]) {
+				t.Errorf("decryptStream() did not return the plaintext")
+			}
+		})
+	}
+}
+
+func TestStream_Tampering(t *testing.T) {
+	const chunkSize = 32
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	tnt2Machine.SetIndex(big.NewInt(5))
+	plaintext := make([]byte, 3*chunkSize+10)
+	rand.New(rand.NewSource(2)).Read(plaintext)
+	stream := encryptStream(t, &tnt2Machine, plaintext, chunkSize, len(plaintext))
+	hdrLen := len((&StreamHeader{StreamVersion, flagsKeyCheck | flagsConfig, chunkSize, big.NewInt(5), tnt2Machine.KeyCheck(), tnt2Machine.ConfigFingerprint()}).marshal())
+	chunk := func(i int) []byte {
+		off := hdrLen + i*(chunkSize+StreamTagSize)
+		return stream[off : off+chunkSize+StreamTagSize]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	flip := func(off int) []byte {
+		s := append([]byte(nil), stream...)
+		s[off] ^= 1
+		return s
+	}
+	tests := []struct {
+		name     string
+		stream   []byte
+		wantErr  error
+		wantRead int // The number of plaintext bytes returned before the error.
+	}{
+		{name: "tst1", stream: flip(hdrLen + 3), wantErr: ErrStreamAuth},
+		{name: "tst2", stream: flip(hdrLen + chunkSize + StreamTagSize + chunkSize), wantErr: ErrStreamAuth, wantRead: chunkSize},
+		{name: "tst3", stream: flip(len(stream) - 1), wantErr: ErrStreamAuth, wantRead: 3 * chunkSize},
+		{name: "tst4", stream: flip(hdrLen - 1), wantErr: ErrStreamAuth},
+		{name: "tst5", stream: join(stream[:hdrLen], chunk(1), chunk(0)), wantErr: ErrStreamAuth},
+		{name: "tst6", stream: stream[:hdrLen+2*(chunkSize+StreamTagSize)], wantErr: ErrStreamAuth, wantRead: chunkSize},
+		{name: "tst7", stream: stream[:len(stream)-StreamTagSize-5], wantErr: ErrStreamTruncated, wantRead: 3 * chunkSize},
+		{name: "tst8", stream: join(stream, chunk(0)), wantErr: ErrStreamAuth, wantRead: 3 * chunkSize},
+		{name: "tst9", stream: stream[:hdrLen-1], wantErr: ErrStreamHeader},
+		{name: "tst10", stream: flip(0), wantErr: ErrStreamHeader},
+		{name: "tst11", stream: flip(9), wantErr: ErrStreamHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decryptStream(&tnt2Machine, tt.stream)
+			if err != tt.wantErr {
+				t.Errorf("decryptStream() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(got) != tt.wantRead || !bytes.Equal(got, plaintext[:len(got)]) {
+				t.Errorf("decryptStream() returned %d bytes, want %d bytes of plaintext", len(got), tt.wantRead)
+			}
+		})
+	}
+	// A different secret key is detected by the key check value, and fails
+	// authentication if the key check value is removed.
+	var other Tnt2Engine
+	other.Init([]byte("OtherKey"), "")
+	if _, err := decryptStream(&other, stream); err != ErrWrongKey {
+		t.Errorf("decryptStream() with the wrong key error = %v, want %v", err, ErrWrongKey)
+	}
+	noCheck := join(stream[:10], stream[10+KeyCheckSize:])
+	noCheck[5] &^= flagsKeyCheck
+	if _, err := decryptStream(&other, noCheck); err != ErrStreamAuth {
+		t.Errorf("decryptStream() with the wrong key and no key check error = %v, want %v", err, ErrStreamAuth)
+	}
+	if _, err := decryptStream(&tnt2Machine, noCheck); err != ErrStreamAuth {
+		t.Errorf("decryptStream() with the key check removed error = %v, want %v", err, ErrStreamAuth)
+	}
+	// The same secret key with a different proforma machine is detected by
+	// the configuration fingerprint.
+	other.Init([]byte("SecretKey"), "files/test.proforma.json")
+	if _, err := decryptStream(&other, stream); err != ErrConfigMismatch {
+		t.Errorf("decryptStream() with a different configuration error = %v, want %v", err, ErrConfigMismatch)
+	}
+}
+
+func TestStream_TailModes(t *testing.T) {
+	const chunkSize = 2 * 32
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	plaintext := make([]byte, 4*chunkSize+CipherBlockBytes)
+	rand.New(rand.NewSource(3)).Read(plaintext)
+	for _, mode := range []TailMode{TailPlain, TailSteal, TailPad} {
+		for size := 0; size <= len(plaintext); size++ {
+			start := big.NewInt(77)
+			tnt2Machine.SetIndex(start)
+			opts := StreamOptions{ChunkSize: chunkSize, Tail: mode}
+			stream := encryptStreamOptions(t, &tnt2Machine, plaintext[:size], opts, 19)
+			// The number of chunks, and of ciphertext bytes in them.
+			chunks, ctLen := size/chunkSize+1, size
+			switch mode {
+			case TailSteal:
+				if size > chunkSize && size%chunkSize > 0 && size%chunkSize < CipherBlockBytes {
+					chunks--
+				}
+				if size > 0 && size < CipherBlockBytes {
+					ctLen = CipherBlockBytes
+				}
+			case TailPad:
+				ctLen = len(padBlocks(plaintext[:size]))
+			}
+			if size > 0 && size%chunkSize == 0 {
+				chunks--
+			}
+			wantNext := big.NewInt(int64(77 + (ctLen+CipherBlockBytes-1)/CipherBlockBytes))
+			if tnt2Machine.Index().Cmp(wantNext) != 0 {
+				t.Errorf("%s %d: Index() after Close = %s, want %s", mode, size, tnt2Machine.Index(), wantNext)
+			}
+			header := (&StreamHeader{StreamVersion, byte(mode) | flagsKeyCheck | flagsConfig, chunkSize, start, tnt2Machine.KeyCheck(), tnt2Machine.ConfigFingerprint()}).marshal()
+			if got, want := len(stream)-len(header), ctLen+chunks*StreamTagSize; got != want {
+				t.Errorf("%s %d: len(stream) - len(header) = %d, want %d", mode, size, got, want)
+			}
+			sr, err := NewStreamReader(bytes.NewReader(stream), &tnt2Machine)
+			if err != nil {
+				t.Fatalf("%s %d: NewStreamReader() error = %v", mode, size, err)
+			}
+			if h := sr.Header(); h.Tail() != mode {
+				t.Errorf("%s %d: Header().Tail() = %s", mode, size, h.Tail())
+			}
+			// The header records whether a TailSteal message shorter
+			// than a block was padded.
+			if got, want := sr.Header().Flags&flagsTailPad != 0, mode == TailSteal && size > 0 && size < CipherBlockBytes; got != want {
+				t.Errorf("%s %d: the header flag of a padded block = %t, want %t", mode, size, got, want)
+			}
+			got, err := io.ReadAll(sr)
+			if err != nil || !bytes.Equal(got, plaintext[:size]) {
+				t.Fatalf("%s %d: the stream did not decrypt to the plaintext: %v", mode, size, err)
+			}
+			if mode == TailPlain || size == 0 {
+				continue
+			}
+			// Changing the last byte of the ciphertext fails authentication.
+			stream[len(stream)-StreamTagSize-1] ^= 1
+			if _, err = decryptStream(&tnt2Machine, stream); err != ErrStreamAuth {
+				t.Errorf("%s %d: decryptStream() of a changed stream error = %v, want %v", mode, size, err, ErrStreamAuth)
+			}
+		}
+	}
+	tnt2Machine.SetIndex(BigZero)
+	stream := encryptStreamOptions(t, &tnt2Machine, plaintext, StreamOptions{ChunkSize: chunkSize, Tail: TailSteal}, 1)
+	for _, flags := range []byte{flagsKeyCheck | 3, 0x80, 0x81, flagsKeyCheck | flagsConfig | flagsTailPad | byte(TailPad)} {
+		bad := append([]byte(nil), stream...)
+		bad[5] = flags
+		if _, err := decryptStream(&tnt2Machine, bad); err != ErrStreamHeader {
+			t.Errorf("decryptStream() with flags %#x error = %v, want %v", flags, err, ErrStreamHeader)
+		}
+	}
+	if _, err := NewStreamWriterOptions(io.Discard, &tnt2Machine, StreamOptions{ChunkSize: chunkSize, Tail: 3}); err != errTailMode {
+		t.Errorf("NewStreamWriterOptions() with tail mode 3 error = %v, want %v", err, errTailMode)
+	}
+}
+
+func TestStream_Padding(t *testing.T) {
+	const chunkSize = 2 * 32
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	plaintext := make([]byte, 600)
+	rand.New(rand.NewSource(5)).Read(plaintext)
+	tests := []struct {
+		name    string
+		policy  PadPolicy
+		buckets [][2]int // Ranges of message sizes giving the same stream size.
+	}{
+		{name: "tsp1", policy: PadMultiple(100), buckets: [][2]int{{0, 100}, {101, 200}, {501, 600}}},
+		{name: "tsp2", policy: PadPowerOfTwo(), buckets: [][2]int{{65, 128}, {257, 512}}},
+	}
+	for _, tt := range tests {
+		for _, mode := range []TailMode{TailPlain, TailSteal, TailPad} {
+			opts := StreamOptions{ChunkSize: chunkSize, Tail: mode, Padding: tt.policy}
+			for _, bucket := range tt.buckets {
+				streamLen := -1
+				for size := bucket[0]; size <= bucket[1]; size++ {
+					tnt2Machine.SetIndex(big.NewInt(9))
+					stream := encryptStreamOptions(t, &tnt2Machine, plaintext[:size], opts, 50)
+					if streamLen < 0 {
+						streamLen = len(stream)
+					} else if len(stream) != streamLen {
+						t.Fatalf("%s %s: len(stream) of %d bytes = %d, want %d", tt.name, mode, size, len(stream), streamLen)
+					}
+					sr, err := NewStreamReader(bytes.NewReader(stream), &tnt2Machine)
+					if err != nil {
+						t.Fatalf("%s %s: NewStreamReader() error = %v", tt.name, mode, err)
+					}
+					if h := sr.Header(); !h.Padded() || h.Tail() != mode {
+						t.Errorf("%s %s: Header() = %+v", tt.name, mode, h)
+					}
+					got, err := io.ReadAll(sr)
+					if err != nil || !bytes.Equal(got, plaintext[:size]) {
+						t.Fatalf("%s %s %d: the stream did not decrypt to the plaintext: %v", tt.name, mode, size, err)
+					}
+				}
+			}
+		}
+	}
+	// The padding fills whole chunks, which still decrypt and authenticate.
+	tnt2Machine.SetIndex(BigZero)
+	stream := encryptStreamOptions(t, &tnt2Machine, plaintext[:10], StreamOptions{ChunkSize: chunkSize, Padding: PadMultiple(10 * chunkSize)}, 10)
+	stream[len(stream)-StreamTagSize-1] ^= 1
+	if _, err := decryptStream(&tnt2Machine, stream); err != ErrStreamAuth {
+		t.Errorf("decryptStream() of a changed padding chunk error = %v, want %v", err, ErrStreamAuth)
+	}
+	// Random padding is drawn from the engine, so the same stream is padded
+	// the same way each time it is encrypted.
+	random, _ := PadRandom(0, 5*chunkSize)
+	sizes := make(map[int]bool)
+	for start := int64(0); start < 10; start++ {
+		tnt2Machine.SetIndex(big.NewInt(start * 100))
+		stream := encryptStreamOptions(t, &tnt2Machine, plaintext[:10], StreamOptions{ChunkSize: chunkSize, Padding: random}, 10)
+		tnt2Machine.SetIndex(big.NewInt(start * 100))
+		if again := encryptStreamOptions(t, &tnt2Machine, plaintext[:10], StreamOptions{ChunkSize: chunkSize, Padding: random}, 10); !bytes.Equal(again, stream) {
+			t.Errorf("the stream starting at block %d was padded differently each time", start*100)
+		}
+		// A policy that wraps it still draws the padding from the engine.
+		tnt2Machine.SetIndex(big.NewInt(start * 100))
+		wrapped := struct{ EnginePadPolicy }{random}
+		if again := encryptStreamOptions(t, &tnt2Machine, plaintext[:10], StreamOptions{ChunkSize: chunkSize, Padding: wrapped}, 10); !bytes.Equal(again, stream) {
+			t.Errorf("the stream starting at block %d was padded differently by a wrapped policy", start*100)
+		}
+		if got, err := decryptStream(&tnt2Machine, stream); err != nil || !bytes.Equal(got, plaintext[:10]) {
+			t.Errorf("decryptStream() of a randomly padded stream = %x, %v", got, err)
+		}
+		sizes[len(stream)] = true
+	}
+	if len(sizes) < 2 {
+		t.Errorf("random padding gave %d different stream sizes", len(sizes))
+	}
+	for _, plaintext := range [][]byte{{0, 0, 0}, {0, 0, 0, 3, 1, 2}} {
+		if _, err := chunkMessage(plaintext); err != ErrPadding {
+			t.Errorf("chunkMessage(%x) error = %v, want %v", plaintext, err, ErrPadding)
+		}
+	}
+}
+
+func TestNewStreamWriter(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	for _, chunkSize := range []int{0, -32, 33, MaxChunkSize + CipherBlockBytes} {
+		if _, err := NewStreamWriter(io.Discard, &tnt2Machine, chunkSize); err != errChunkSize {
+			t.Errorf("NewStreamWriter(%d) error = %v, want %v", chunkSize, err, errChunkSize)
+		}
+	}
+	sw, err := NewStreamWriter(io.Discard, &tnt2Machine, DefaultChunkSize)
+	if err != nil {
+		t.Fatalf("NewStreamWriter() error = %v", err)
+	}
+	if err = sw.Close(); err != nil {
+		t.Errorf("StreamWriter.Close() error = %v", err)
+	}
+	if err = sw.Close(); err != nil {
+		t.Errorf("second StreamWriter.Close() error = %v", err)
+	}
+	if _, err = sw.Write([]byte("x")); err != ErrStreamClosed {
+		t.Errorf("StreamWriter.Write() after Close error = %v, want %v", err, ErrStreamClosed)
+	}
+}
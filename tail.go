@@ -0,0 +1,166 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+// Define the ways a message that does not end on a block boundary can be
+// encrypted so that its last bytes also pass through the permutators.
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// TailMode selects how the short final block of a message is encrypted.
+type TailMode byte
+
+const (
+	// TailPlain encrypts the short final block as it is.  The permutators
+	// do not permute a short block, so its bytes are only changed by the
+	// rotors.
+	TailPlain TailMode = iota
+	// TailSteal uses ciphertext stealing: the short final block is
+	// filled with the end of the encrypted block before it and encrypted
+	// as a full block, which keeps the length of the message.  A message
+	// shorter than one block is padded instead.
+	TailSteal
+	// TailPad pads the message to a multiple of CipherBlockBytes, with 1
+	// to CipherBlockBytes bytes each holding the number of bytes added.
+	TailPad
+)
+
+var tailModeNames = [...]string{"plain", "steal", "pad"}
+
+// String returns the name of the tail mode.
+func (m TailMode) String() string {
+	if int(m) < len(tailModeNames) {
+		return tailModeNames[m]
+	}
+	return fmt.Sprintf("TailMode(%d)", int(m))
+}
+
+// ErrPadding is returned when the padding of a decrypted message is invalid.
+var ErrPadding = errors.New("tnt2engine: invalid padding")
+
+// padBlocks returns a copy of data padded to a multiple of CipherBlockBytes.
+// At least one byte is always added, and each added byte holds the number of
+// bytes added.
+func padBlocks(data []byte) []byte {
+	pad := CipherBlockBytes - len(data)%CipherBlockBytes
+	res := make([]byte, len(data)+pad)
+	copy(res, data)
+	for i := len(data); i < len(res); i++ {
+		res[i] = byte(pad)
+	}
+	return res
+}
+
+// unpadBlocks removes the padding added by padBlocks.
+func unpadBlocks(data []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%CipherBlockBytes != 0 {
+		return nil, ErrPadding
+	}
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > CipherBlockBytes {
+		return nil, ErrPadding
+	}
+	for _, v := range data[len(data)-pad:] {
+		if int(v) != pad {
+			return nil, ErrPadding
+		}
+	}
+	return data[:len(data)-pad], nil
+}
+
+// encryptSteal encrypts data, starting at block start, using ciphertext
+// stealing for the short final block.  With the last full block encrypted to
+// Y = Yh || Yt, where Yh is as long as the short block P, P || Yt is encrypted
+// as the final block (at the next block number) to give Z.  Z takes the place
+// of Y and Yh becomes the short final block.  data must be at least
+// CipherBlockBytes long.
+func encryptSteal(e *Tnt2Engine, data []byte, start *big.Int) ([]byte, error) {
+	r := len(data) % CipherBlockBytes
+	e.SetIndex(start)
+	res, err := runMachine(e, "E", data[:len(data)-r])
+	if err != nil || r == 0 {
+		return res, err
+	}
+	y := res[len(res)-CipherBlockBytes:]
+	last := append(append(make([]byte, 0, CipherBlockBytes), data[len(data)-r:]...), y[r:]...)
+	z, err := runMachine(e, "E", last)
+	if err != nil {
+		return nil, err
+	}
+	yh := append([]byte(nil), y[:r]...)
+	copy(y, z)
+	return append(res, yh...), nil
+}
+
+// decryptSteal decrypts data that was encrypted by encryptSteal starting at
+// block start.  The final (full) block is decrypted first to recover P || Yt,
+// then Yh || Yt is decrypted as the block before it.  The engine is left at the
+// block following the message, as it is by encryptSteal.
+func decryptSteal(e *Tnt2Engine, data []byte, start *big.Int) ([]byte, error) {
+	r := len(data) % CipherBlockBytes
+	if r == 0 || len(data) < CipherBlockBytes {
+		e.SetIndex(start)
+		return runMachine(e, "D", data)
+	}
+	full := len(data) - r
+	yIdx := new(big.Int).Add(start, big.NewInt(int64(full/CipherBlockBytes-1)))
+	e.SetIndex(new(big.Int).Add(yIdx, BigOne))
+	last, err := runMachine(e, "D", data[full-CipherBlockBytes:full])
+	if err != nil {
+		return nil, err
+	}
+	y := append(append(make([]byte, 0, CipherBlockBytes), data[full:]...), last[r:]...)
+	e.SetIndex(start)
+	res, err := runMachine(e, "D", append(append(make([]byte, 0, len(data)), data[:full-CipherBlockBytes]...), y...))
+	if err != nil {
+		return nil, err
+	}
+	e.Skip(1)
+	return append(res, last[:r]...), nil
+}
+
+// tailPadded reports whether encryptTail pads n bytes of data using the given
+// tail mode.  TailSteal needs a full block to steal from, so a message shorter
+// than a block is padded.
+func tailPadded(mode TailMode, n int) bool {
+	return mode == TailPad || mode == TailSteal && n > 0 && n < CipherBlockBytes
+}
+
+// encryptTail encrypts data, the end of a message, starting at block start
+// using the given tail mode.  It reports whether the data was padded.
+func encryptTail(e *Tnt2Engine, mode TailMode, data []byte, start *big.Int) (res []byte, padded bool, err error) {
+	switch {
+	case tailPadded(mode, len(data)):
+		e.SetIndex(start)
+		res, err = runMachine(e, "E", padBlocks(data))
+		return res, true, err
+	case mode == TailSteal:
+		res, err = encryptSteal(e, data, start)
+		return res, false, err
+	}
+	e.SetIndex(start)
+	res, err = runMachine(e, "E", data)
+	return res, false, err
+}
+
+// decryptTail decrypts data that was encrypted by encryptTail.
+func decryptTail(e *Tnt2Engine, mode TailMode, data []byte, start *big.Int, padded bool) ([]byte, error) {
+	switch {
+	case padded:
+		e.SetIndex(start)
+		res, err := runMachine(e, "D", data)
+		if err != nil {
+			return nil, err
+		}
+		return unpadBlocks(res)
+	case mode == TailSteal:
+		return decryptSteal(e, data, start)
+	}
+	e.SetIndex(start)
+	return runMachine(e, "D", data)
+}
@@ -0,0 +1,96 @@
+// This is free and unencumbered software released into the public domain.
+// See the UNLICENSE file for details.
+
+package tnt2engine
+
+import (
+	"bytes"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+func TestEncryptSteal(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	plaintext := make([]byte, 5*CipherBlockBytes)
+	rand.New(rand.NewSource(4)).Read(plaintext)
+	start := big.NewInt(321)
+	for size := CipherBlockBytes; size <= len(plaintext); size++ {
+		data := plaintext[:size]
+		got, err := encryptSteal(&tnt2Machine, data, start)
+		if err != nil {
+			t.Fatalf("encryptSteal() error = %v", err)
+		}
+		blocks := int64((size + CipherBlockBytes - 1) / CipherBlockBytes)
+		if want := new(big.Int).Add(start, big.NewInt(blocks)); tnt2Machine.Index().Cmp(want) != 0 {
+			t.Errorf("%d: Index() after encryptSteal = %s, want %s", size, tnt2Machine.Index(), want)
+		}
+		if len(got) != size {
+			t.Fatalf("%d: len(encryptSteal()) = %d", size, len(got))
+		}
+		// Only the last full block and the short block differ from the
+		// message encrypted as a whole.
+		plain := encryptMessage(t, &tnt2Machine, data, start)
+		r := size % CipherBlockBytes
+		same := size - r
+		if r != 0 {
+			same -= CipherBlockBytes
+		}
+		if !bytes.Equal(got[:same], plain[:same]) {
+			t.Errorf("%d: encryptSteal() changed the blocks before the last full block", size)
+		}
+		if r != 0 && bytes.Equal(got[same:], plain[same:]) {
+			t.Errorf("%d: encryptSteal() did not change the end of the message", size)
+		}
+		dec, err := decryptSteal(&tnt2Machine, got, start)
+		if err != nil || !bytes.Equal(dec, data) {
+			t.Fatalf("%d: decryptSteal() did not decrypt the message: %v", size, err)
+		}
+		if want := new(big.Int).Add(start, big.NewInt(blocks)); tnt2Machine.Index().Cmp(want) != 0 {
+			t.Errorf("%d: Index() after decryptSteal = %s, want %s", size, tnt2Machine.Index(), want)
+		}
+	}
+}
+
+func TestUnpadBlocks(t *testing.T) {
+	for size := 0; size <= 3*CipherBlockBytes; size++ {
+		data := make([]byte, size)
+		padded := padBlocks(data)
+		if len(padded)%CipherBlockBytes != 0 || len(padded) <= size || len(padded) > size+CipherBlockBytes {
+			t.Fatalf("len(padBlocks(%d bytes)) = %d", size, len(padded))
+		}
+		if got, err := unpadBlocks(padded); err != nil || len(got) != size {
+			t.Fatalf("unpadBlocks(padBlocks(%d bytes)) = %d bytes, %v", size, len(got), err)
+		}
+	}
+	bad := [][]byte{
+		nil,
+		make([]byte, CipherBlockBytes-1),
+		make([]byte, CipherBlockBytes),
+		append(make([]byte, CipherBlockBytes-1), byte(CipherBlockBytes+1)),
+		append(make([]byte, CipherBlockBytes-2), 1, 2),
+	}
+	for _, data := range bad {
+		if _, err := unpadBlocks(data); err != ErrPadding {
+			t.Errorf("unpadBlocks(%x) error = %v, want %v", data, err, ErrPadding)
+		}
+	}
+}
+
+func TestTailMode_String(t *testing.T) {
+	tests := []struct {
+		mode TailMode
+		want string
+	}{
+		{TailPlain, "plain"},
+		{TailSteal, "steal"},
+		{TailPad, "pad"},
+		{TailMode(7), "TailMode(7)"},
+	}
+	for _, tt := range tests {
+		if got := tt.mode.String(); got != tt.want {
+			t.Errorf("TailMode.String() = %v, want %v", got, tt.want)
+		}
+	}
+}
@@ -7,7 +7,10 @@ package tnt2engine
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -15,6 +18,7 @@ import (
 	"math/big"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/bgallie/jc1"
 )
@@ -163,8 +167,24 @@ var (
 			225, 126, 54, 36, 220, 208, 150, 117, 255, 221, 101, 69, 77, 110, 243, 206,
 			130, 59, 205, 242, 184, 164, 131, 12, 2, 119, 96, 171, 53, 68, 8, 145}),
 	}
-	counter *Counter = new(Counter)
-	jc1Key  *jc1.UberJc1
+	// initMu serializes calls to Init, which use the package level
+	// rotorSizesIndex.
+	initMu sync.Mutex
+	// keyCheckBlock is the block encrypted to give the key check value.
+	keyCheckBlock = [32]byte{'t', 'n', 't', '2', 'e', 'n', 'g', 'i', 'n', 'e', ' ', 'k', 'e', 'y', ' ', 'c', 'h', 'e', 'c', 'k'}
+)
+
+const (
+	// KeyCheckSize is the size of the key check value returned by KeyCheck.
+	KeyCheckSize = 4
+	// KeyScheduleVersion identifies the way Init creates the rotors and
+	// permutators from the secret key and the proforma machine.  It must be
+	// changed whenever a change to Init would create a different engine
+	// from the same secret key.
+	KeyScheduleVersion = 1
+	// ConfigFingerprintSize is the size of the value returned by
+	// ConfigFingerprint.
+	ConfigFingerprintSize = sha256.Size
 )
 
 // Tnt2Engine type defines the encryption/decryption machine (rotors and
@@ -174,7 +194,20 @@ type Tnt2Engine struct {
 	engine        []Crypter
 	left, right   chan CipherBlock
 	cntrKey       CipherBlock
+	randSeed      CipherBlock // The first block used by a Rand of the engine.
+	keyCheck      []byte
+	configPrint   []byte
 	maximalStates *big.Int
+	// The batched cipher machine and the number of batches buffered between
+	// each of its stages.
+	batchLeft, batchRight chan CipherBatch
+	pipelineDepth         int
+	// The state of the engine, and the cancel function and done channel of
+	// the running cipher machine (see state.go).
+	state        EngineState
+	cancel       context.CancelFunc
+	done         chan struct{}
+	batchRunning bool
 }
 
 // Left is a getter that returns the input channel for the Tnt2Engine.
@@ -194,30 +227,146 @@ func (e *Tnt2Engine) CounterKey() string {
 	return base64.RawStdEncoding.EncodeToString(e.cntrKey)
 }
 
-// Index is a getter that returns the block number of the next block to be
-// encrypted.
-func (e *Tnt2Engine) Index() (cntr *big.Int) {
+// KeyCheck returns a copy of the key check value of the engine, a short
+// fingerprint of the secret key that can be stored with ciphertext (or shown to
+// a user) to detect the use of the wrong key before decrypting.  It is the
+// first KeyCheckSize bytes of the SHA-256 hash of a fixed block encrypted by
+// the engine at block 0, so it does not reveal the output of the engine.
+func (e *Tnt2Engine) KeyCheck() []byte {
+	return append([]byte(nil), e.keyCheck...)
+}
+
+// ConfigFingerprint returns a copy of the fingerprint of the configuration of
+// the engine: everything used to create the engine except the secret key.  It
+// is the SHA-256 hash of KeyScheduleVersion, the EngineLayout, the contents of
+// the proforma machine, RotorSizes, and CycleSizes as they were when Init was
+// called.  Engines created from the same secret key only match if their
+// fingerprints do.
+func (e *Tnt2Engine) ConfigFingerprint() []byte {
+	return append([]byte(nil), e.configPrint...)
+}
+
+// configFingerprint returns the fingerprint of the current configuration using
+// the given proforma machine.
+func configFingerprint(proForma []Crypter) []byte {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, int64(KeyScheduleVersion))
+	binary.Write(h, binary.BigEndian, int64(len(EngineLayout)))
+	io.WriteString(h, EngineLayout)
+	binary.Write(h, binary.BigEndian, int64(len(proForma)))
+	for _, machine := range proForma {
+		switch v := machine.(type) {
+		case *Rotor:
+			binary.Write(h, binary.BigEndian, [4]int64{'r', int64(v.Size), int64(v.Start), int64(v.Step)})
+			binary.Write(h, binary.BigEndian, int64(len(v.Rotor)))
+			h.Write(v.Rotor)
+		case *Permutator:
+			binary.Write(h, binary.BigEndian, [2]int64{'p', int64(len(v.Cycles))})
+			for _, cycle := range v.Cycles {
+				binary.Write(h, binary.BigEndian, [2]int64{int64(cycle.Start), int64(cycle.Length)})
+			}
+			binary.Write(h, binary.BigEndian, int64(len(v.Randp)))
+			h.Write(v.Randp)
+		}
+	}
+	binary.Write(h, binary.BigEndian, int64(len(RotorSizes)))
+	for _, size := range RotorSizes {
+		binary.Write(h, binary.BigEndian, int64(size))
+	}
+	binary.Write(h, binary.BigEndian, int64(len(CycleSizes)))
+	for _, size := range CycleSizes {
+		binary.Write(h, binary.BigEndian, int64(size))
+	}
+	return h.Sum(nil)
+}
+
+// deriveKey returns a 32 byte key for the given purpose (label) that is derived
+// from the secret state of the engine, i.e. the contents of the rotors and the
+// permutators.  Unlike the counter key, which is stored in the clear to find
+// the next block to use, it can only be derived by someone with the secret key.
+func (e *Tnt2Engine) deriveKey(label string) []byte {
+	h := sha256.New()
+	h.Write([]byte{byte(len(label))})
+	io.WriteString(h, label)
+	for _, machine := range e.engine {
+		switch v := machine.(type) {
+		case *Rotor:
+			binary.Write(h, binary.BigEndian, [3]int64{int64(v.Size), int64(v.Start), int64(v.Step)})
+			h.Write(v.Rotor)
+		case *Permutator:
+			for _, cycle := range v.Cycles {
+				binary.Write(h, binary.BigEndian, [2]int64{int64(cycle.Start), int64(cycle.Length)})
+			}
+			h.Write(v.Randp)
+		}
+	}
+	return h.Sum(nil)
+}
+
+// Index is a getter that returns a copy of the block number of the next block
+// to be encrypted.
+func (e *Tnt2Engine) Index() *big.Int {
 	if len(e.engine) != 0 {
-		machine := e.engine[len(e.engine)-1]
-		switch machine.(type) {
-		default:
-			cntr = BigZero
-		case *Counter:
-			cntr = machine.Index()
+		if cntr, ok := e.engine[len(e.engine)-1].(*Counter); ok && cntr.index != nil {
+			return cntr.Index()
 		}
 	}
+	return new(big.Int)
+}
 
-	return
+// Processed is a getter function that returns the number of blocks and bytes
+// that were encrypted or decrypted since the last call to SetIndex.  This lets
+// code that decrypts a stream in pieces find its place in the stream.
+func (e *Tnt2Engine) Processed() (blocks, bytes uint64) {
+	if len(e.engine) != 0 {
+		if cntr, ok := e.engine[len(e.engine)-1].(*Counter); ok {
+			return cntr.Processed()
+		}
+	}
+	return 0, 0
 }
 
 // SetIndex is a setter function that sets the rotors and permutators so that
 // the TntEngine will be ready start encrypting/decrypting at the correct block.
 func (e *Tnt2Engine) SetIndex(iCnt *big.Int) {
+	if iCnt.IsUint64() {
+		e.SetIndexUint64(iCnt.Uint64())
+		return
+	}
 	for _, machine := range e.engine {
 		machine.SetIndex(new(big.Int).Set(iCnt))
 	}
 }
 
+// SetIndexUint64 is SetIndex for a block number that fits in a uint64.  The
+// rotors and permutators are positioned using native arithmetic instead of
+// big.Int arithmetic.
+func (e *Tnt2Engine) SetIndexUint64(idx uint64) {
+	for _, machine := range e.engine {
+		if m, ok := machine.(uint64Indexer); ok {
+			m.SetIndexUint64(idx)
+		} else {
+			machine.SetIndex(new(big.Int).SetUint64(idx))
+		}
+	}
+}
+
+// Skip advances the rotors, permutators, and counter by n blocks, as if n full
+// blocks had been encrypted, without processing any data.  Since the
+// permutators do not step for a short block, use SetIndex rather than Skip
+// after a short block has been processed.
+func (e *Tnt2Engine) Skip(n uint64) {
+	next := e.Index()
+	next.Add(next, new(big.Int).SetUint64(n))
+	for _, machine := range e.engine {
+		if m, ok := machine.(uint64Indexer); ok {
+			m.Skip(n)
+		} else {
+			machine.SetIndex(next)
+		}
+	}
+}
+
 // SetEngineType is a setter function that sets the engineType [D)ecrypt or E)crypt]
 // of the Tnt2Engine.
 func (e *Tnt2Engine) SetEngineType(engineType string) {
@@ -242,10 +391,13 @@ func (e *Tnt2Engine) EngineType() string {
 	return e.engineType
 }
 
-// MaximalStates is a getter function that returns maximum number of states that the
-// engine can be in before repeating.
+// MaximalStates is a getter function that returns a copy of the maximum number of
+// states that the engine can be in before repeating.
 func (e *Tnt2Engine) MaximalStates() *big.Int {
-	return e.maximalStates
+	if e.maximalStates == nil {
+		return nil
+	}
+	return new(big.Int).Set(e.maximalStates)
 }
 
 func countLayoutType(cType rune) int {
@@ -264,7 +416,15 @@ func countLayoutType(cType rune) int {
 func (e *Tnt2Engine) Init(secret []byte, proFormaFileName string) {
 	rCnt := countLayoutType('r')
 	pCnt := countLayoutType('p')
-	jc1Key = new(jc1.UberJc1).New(secret)
+	initMu.Lock()
+	defer initMu.Unlock()
+	if e.State() == Running {
+		e.stopMachine()
+	}
+	// The key stream derived from the secret key is only kept until Init
+	// returns.
+	jc1Key := new(jc1.UberJc1).New(secret)
+	e.pipelineDepth = DefaultPipelineDepth
 	// Create an encryption machine based on the proForma rotors and permutators.
 	var pfmReader io.Reader = nil
 	if len(proFormaFileName) != 0 {
@@ -274,7 +434,8 @@ func (e *Tnt2Engine) Init(secret []byte, proFormaFileName string) {
 		pfmReader = bufio.NewReader(in)
 	}
 	e.engine = *createProFormaMachine(pfmReader)
-	e.left, e.right = createEncryptMachine(e.engine...)
+	e.configPrint = configFingerprint(e.engine)
+	e.startMachine(context.Background(), false, false)
 	e.SetIndex(BigZero)
 	// Set up a counterKey based on the proforma encryption machine.
 	// It will be set up again once the new encryption machine is created.
@@ -285,6 +446,7 @@ func (e *Tnt2Engine) Init(secret []byte, proFormaFileName string) {
 	_ = copy(e.cntrKey, nBlk)
 	// Create a random number function [func(max int) int] that uses pseudo-
 	// random data generated the proforma encryption machine.
+	e.randSeed = jc1Key.XORKeyStream(e.cntrKey)
 	random := new(Rand).New(e)
 	// Get the last _rCnt_ rotor sizes (to maximize the period of the generator).
 	rotorSizesIndex = len(RotorSizes) - 1
@@ -345,43 +507,158 @@ func (e *Tnt2Engine) Init(secret []byte, proFormaFileName string) {
 			pIdx++
 		}
 	}
+	counter := new(Counter)
 	counter.SetIndex(BigZero)
 	newMachine[len(newMachine)-1] = counter
-	e.CloseCipherMachine()
+	e.stopMachine()
 	e.engine = newMachine
 	// Encrypt the UberJc1 hash of the password using the generated encryption
 	// machine.  This is used as a key to store the count of blocks already
 	// encrypted to use as a starting point for the encryption of the next message.
-	e.left, e.right = createEncryptMachine(e.engine...)
+	e.startMachine(context.Background(), false, false)
 	e.left <- jc1Key.XORKeyStream(blk)
 	nBlk = <-e.right
 	_ = copy(e.cntrKey, nBlk)
-	counter.SetIndex(BigZero)
-	e.CloseCipherMachine()
+	// Seed any Rand created from the engine after Init.
+	zeroBytes(e.randSeed)
+	e.randSeed = jc1Key.XORKeyStream(e.cntrKey)
+	// Encrypt a fixed block at block 0 for the key check value.
+	e.SetIndex(BigZero)
+	e.left <- append(CipherBlock(nil), keyCheckBlock[:]...)
+	nBlk = <-e.right
+	sum := sha256.Sum256(nBlk)
+	e.keyCheck = sum[:KeyCheckSize]
+	e.stopMachine()
+	e.SetIndex(BigZero)
+}
+
+// Clone returns a copy of the engine with its own rotors, permutators, and
+// counter, so that the copy can be used at the same time as the original (e.g.
+// by an EnginePool) without calling Init again.  The lookup tables of the
+// permutators are shared since they are never changed after they are built.
+// The copy does not have a cipher machine running.  Clone must not be called
+// while the cipher machine of e is processing blocks.
+func (e *Tnt2Engine) Clone() *Tnt2Engine {
+	c := new(Tnt2Engine)
+	c.engineType = e.engineType
+	c.engine = make([]Crypter, len(e.engine))
+	for idx, machine := range e.engine {
+		switch v := machine.(type) {
+		case *Rotor:
+			r := *v
+			r.Rotor = append([]byte(nil), v.Rotor...)
+			c.engine[idx] = &r
+		case *Permutator:
+			p := *v
+			p.Cycles = append([]Cycle(nil), v.Cycles...)
+			p.Randp = append([]byte(nil), v.Randp...)
+			p.fwdTables.share()
+			p.invTables.share()
+			c.engine[idx] = &p
+		case *Counter:
+			cntr := new(Counter)
+			if v.index != nil {
+				cntr.SetIndex(v.index)
+			}
+			c.engine[idx] = cntr
+		default:
+			panic(fmt.Sprintf("can not clone a %T", machine))
+		}
+	}
+	c.cntrKey = append(CipherBlock(nil), e.cntrKey...)
+	c.randSeed = append(CipherBlock(nil), e.randSeed...)
+	c.keyCheck = append([]byte(nil), e.keyCheck...)
+	c.configPrint = append([]byte(nil), e.configPrint...)
+	if e.maximalStates != nil {
+		c.maximalStates = new(big.Int).Set(e.maximalStates)
+	}
+	c.pipelineDepth = e.pipelineDepth
+	switch e.state {
+	case Uninitialized:
+		c.state = Uninitialized
+	default:
+		c.state = Ready
+	}
+	return c
+}
+
+// Wipe closes the engine and overwrites the contents of its rotors and
+// permutators, its counter key, and its key check value, so that they do not
+// remain in memory once the engine is no longer needed.  The lookup tables of
+// the permutators are shared with any clones, so they are only overwritten by
+// the Wipe of the last engine using them; the tables of a clone that is
+// dropped without being wiped are left to the garbage collector.  The engine
+// can not be used again until Init is called.
+func (e *Tnt2Engine) Wipe() {
+	e.Close()
+	for _, machine := range e.engine {
+		switch v := machine.(type) {
+		case *Rotor:
+			zeroBytes(v.Rotor)
+			v.Size, v.Start, v.Step, v.Current = 0, 0, 0, 0
+		case *Permutator:
+			zeroBytes(v.Randp)
+			for idx := range v.Cycles {
+				v.Cycles[idx] = Cycle{}
+			}
+			v.CurrentState = 0
+			v.releaseTables()
+		case *Counter:
+			v.SetIndex(BigZero)
+		}
+	}
+	zeroBytes(e.cntrKey)
+	zeroBytes(e.randSeed)
+	zeroBytes(e.keyCheck)
+	e.engine = nil
+}
+
+// zeroBytes sets every byte of b to zero.
+func zeroBytes(b []byte) {
+	for idx := range b {
+		b[idx] = 0
+	}
 }
 
 // BuildCipherMachine will create a "machine" to encrypt or decrypt data sent to the
 // left channel and outputted on the right channel for the Tnt2Engine.  The engineType
-// determines wither a encrypt machine or a decrypt machine will be created.
-func (e *Tnt2Engine) BuildCipherMachine() {
+// determines wither a encrypt machine or a decrypt machine will be created.  It
+// returns an error if the engine is not Ready.
+func (e *Tnt2Engine) BuildCipherMachine() error {
+	return e.BuildCipherMachineContext(context.Background())
+}
+
+// BuildCipherMachineContext is like BuildCipherMachine, but the go functions that
+// perform the encryption/decryption exit when ctx is cancelled.  The right channel
+// is then closed and the engine returns to the Ready state, positioned at the
+// block following the last block that passed through the whole machine.  Code sending blocks to
+// the left channel should also select on ctx.Done() (or Done()) so that it does not
+// block once the machine has stopped.
+func (e *Tnt2Engine) BuildCipherMachineContext(ctx context.Context) error {
+	if err := e.checkStart(); err != nil {
+		return err
+	}
 	switch e.engineType {
 	case "D":
-		e.left, e.right = createDecryptMachine(e.engine...)
+		e.startMachine(ctx, false, true)
 	case "E":
-		e.left, e.right = createEncryptMachine(e.engine...)
+		e.startMachine(ctx, false, false)
 	default:
 		log.Fatalf("Missing or incorrect Tnt2Engine engineType: [%s]", e.engineType)
-
 	}
+	return nil
 }
 
 // CloseCipherMachine will close down the cipher machine by exiting the go function
 // that performs the encryption/decryption using the individual rotors/permutators.
 // This is done by passing the CipherMachine a CypherBlock with a length of zero (0).
-func (e *Tnt2Engine) CloseCipherMachine() {
-	blk := new(CipherBlock)
-	e.Left() <- *blk
-	<-e.Right()
+// It returns ErrNotRunning, instead of blocking, if the cipher machine is not running.
+func (e *Tnt2Engine) CloseCipherMachine() error {
+	if e.State() != Running || e.batchRunning {
+		return ErrNotRunning
+	}
+	e.stopMachine()
+	return nil
 }
 
 // createProFormaMachine initializes the proForma machine used to create the
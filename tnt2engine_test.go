@@ -5,6 +5,9 @@ package tnt2engine
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"math/big"
 	"os"
@@ -93,6 +96,76 @@ func TestTnt2Engine_CounterKey(t *testing.T) {
 	}
 }
 
+func TestTnt2Engine_KeyCheck(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tests := []struct {
+		name             string
+		key              string
+		proFormaFileName string
+		want             string
+	}{
+		{name: "ttekc1", key: "SecretKey", proFormaFileName: "", want: "bc72e3a9"},
+		{name: "ttekc2", key: "SecretKey", proFormaFileName: "files/test.proforma.json", want: "9b77b674"},
+		{name: "ttekc3", key: "OtherKey", proFormaFileName: "", want: "f5738e85"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tnt2Machine.Init([]byte(tt.key), tt.proFormaFileName)
+			if got := hex.EncodeToString(tnt2Machine.KeyCheck()); got != tt.want {
+				t.Errorf("Tnt2Engine.KeyCheck() = %v, want %v", got, tt.want)
+			}
+			// The key check value is the hash of the key check block
+			// encrypted at block 0.
+			clone := tnt2Machine.Clone()
+			clone.SetIndex(BigZero)
+			blk, err := runMachine(clone, "E", keyCheckBlock[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum := sha256.Sum256(blk); !bytes.Equal(sum[:KeyCheckSize], tnt2Machine.KeyCheck()) {
+				t.Errorf("Tnt2Engine.KeyCheck() = %x, want %x", tnt2Machine.KeyCheck(), sum[:KeyCheckSize])
+			}
+			tnt2Machine.KeyCheck()[0] ^= 1
+			if got := hex.EncodeToString(tnt2Machine.Clone().KeyCheck()); got != tt.want {
+				t.Errorf("Tnt2Engine.Clone().KeyCheck() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTnt2Engine_ConfigFingerprint(t *testing.T) {
+	fingerprint := func(key, proFormaFileName string) []byte {
+		var tnt2Machine Tnt2Engine
+		tnt2Machine.Init([]byte(key), proFormaFileName)
+		return tnt2Machine.Clone().ConfigFingerprint()
+	}
+	base := fingerprint("SecretKey", "")
+	if len(base) != ConfigFingerprintSize {
+		t.Fatalf("len(ConfigFingerprint()) = %d, want %d", len(base), ConfigFingerprintSize)
+	}
+	if got := fingerprint("OtherKey", ""); !bytes.Equal(got, base) {
+		t.Errorf("ConfigFingerprint() depends on the secret key")
+	}
+	if got := fingerprint("SecretKey", "files/test.proforma.json"); bytes.Equal(got, base) {
+		t.Errorf("ConfigFingerprint() does not depend on the proforma machine")
+	}
+	EngineLayout = "rpr"
+	got := fingerprint("SecretKey", "")
+	EngineLayout = "rrprrprr"
+	if bytes.Equal(got, base) {
+		t.Errorf("ConfigFingerprint() does not depend on the EngineLayout")
+	}
+	CycleSizes[0], CycleSizes[1] = CycleSizes[1], CycleSizes[0]
+	got = fingerprint("SecretKey", "")
+	CycleSizes[0], CycleSizes[1] = CycleSizes[1], CycleSizes[0]
+	if bytes.Equal(got, base) {
+		t.Errorf("ConfigFingerprint() does not depend on the CycleSizes")
+	}
+	if got = fingerprint("SecretKey", ""); !bytes.Equal(got, base) {
+		t.Errorf("ConfigFingerprint() changed for the same configuration")
+	}
+}
+
 func TestTnt2Engine_EngineLayout(t *testing.T) {
 	var tnt2Machine Tnt2Engine
 	wantCk1, _ := new(big.Int).SetString("1121232500564085", 10)
@@ -164,6 +237,160 @@ func TestTnt2Engine_Index(t *testing.T) {
 	}
 }
 
+func TestTnt2Engine_Skip(t *testing.T) {
+	var tnt2Machine, want Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	want.Init([]byte("SecretKey"), "")
+	nearMax := new(big.Int).SetUint64(1<<64 - 10)
+	tests := []struct {
+		name  string
+		start *big.Int
+		n     uint64
+	}{
+		{name: "ttes1", start: big.NewInt(5), n: 1000},
+		{name: "ttes2", start: BigZero, n: 1<<64 - 1},
+		{name: "ttes3", start: nearMax, n: 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tnt2Machine.SetIndex(tt.start)
+			tnt2Machine.Skip(tt.n)
+			next := new(big.Int).Add(tt.start, new(big.Int).SetUint64(tt.n))
+			want.SetIndex(next)
+			if got := tnt2Machine.Index(); got.Cmp(next) != 0 {
+				t.Errorf("Tnt2Engine.Index() = %s, want %s", got, next)
+			}
+			if got := engineState(&tnt2Machine); !reflect.DeepEqual(got, engineState(&want)) {
+				t.Errorf("engine state after Skip = %v, want %v", got, engineState(&want))
+			}
+			if next.IsUint64() {
+				want.SetIndexUint64(next.Uint64())
+				if got := engineState(&want); !reflect.DeepEqual(got, engineState(&tnt2Machine)) {
+					t.Errorf("engine state after SetIndexUint64 = %v, want %v", got, engineState(&tnt2Machine))
+				}
+			}
+		})
+	}
+}
+
+func TestTnt2Engine_accessorCopies(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	tnt2Machine.SetIndex(big.NewInt(42))
+	tnt2Machine.Index().SetInt64(7)
+	if got := tnt2Machine.Index(); got.Cmp(big.NewInt(42)) != 0 {
+		t.Errorf("changing the result of Index() changed the index to %s", got)
+	}
+	want := tnt2Machine.MaximalStates()
+	tnt2Machine.MaximalStates().SetInt64(7)
+	if got := tnt2Machine.MaximalStates(); got.Cmp(want) != 0 {
+		t.Errorf("changing the result of MaximalStates() changed it to %s", got)
+	}
+	tnt2Machine.engine = tnt2Machine.engine[:len(tnt2Machine.engine)-1]
+	tnt2Machine.Index().SetInt64(7)
+	new(Tnt2Engine).Index().SetInt64(7)
+	if BigZero.Sign() != 0 {
+		t.Errorf("changing the result of Index() changed BigZero to %s", BigZero)
+	}
+}
+
+func TestTnt2Engine_Wipe(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	plaintext := bytes.Repeat([]byte("0123456789"), 10)
+	tnt2Machine.SetIndex(BigZero)
+	want, _ := runMachine(&tnt2Machine, "E", plaintext)
+	clone := tnt2Machine.Clone()
+	crypters := tnt2Machine.Engine()
+	var tables []*permTables
+	for _, machine := range crypters {
+		if p, ok := machine.(*Permutator); ok {
+			tables = append(tables, p.fwdTables, p.invTables)
+		}
+	}
+	keyCheck, randSeed := tnt2Machine.keyCheck, tnt2Machine.randSeed
+	tnt2Machine.Wipe()
+	if tnt2Machine.State() != Closed {
+		t.Errorf("Tnt2Engine.State() after Wipe = %v, want %v", tnt2Machine.State(), Closed)
+	}
+	if err := tnt2Machine.BuildCipherMachine(); err != ErrEngineClosed {
+		t.Errorf("Tnt2Engine.BuildCipherMachine() after Wipe error = %v, want %v", err, ErrEngineClosed)
+	}
+	for idx, machine := range crypters {
+		switch v := machine.(type) {
+		case *Rotor:
+			if !bytes.Equal(v.Rotor, make([]byte, len(v.Rotor))) {
+				t.Errorf("rotor %d was not wiped", idx)
+			}
+		case *Permutator:
+			if !bytes.Equal(v.Randp, make([]byte, len(v.Randp))) || v.fwdTables != nil {
+				t.Errorf("permutator %d was not wiped", idx)
+			}
+		}
+	}
+	if !bytes.Equal(keyCheck, make([]byte, len(keyCheck))) {
+		t.Errorf("the key check value was not wiped")
+	}
+	if !bytes.Equal(randSeed, make([]byte, len(randSeed))) {
+		t.Errorf("the seed of the random number generator was not wiped")
+	}
+	// A clone made before Wipe still works.
+	clone.SetIndex(BigZero)
+	if got, err := runMachine(clone, "E", plaintext); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("the clone of a wiped engine does not encrypt the same way: %v", err)
+	}
+	// The lookup tables are overwritten by the Wipe of the last engine
+	// using them.
+	clone.Wipe()
+	for idx, pt := range tables {
+		if pt.gather[0][1] != (block256{}) || pt.scatter[0][1] != (block256{}) {
+			t.Errorf("lookup table %d was not wiped", idx)
+		}
+	}
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	tnt2Machine.SetIndex(BigZero)
+	if got, err := runMachine(&tnt2Machine, "E", plaintext); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("a wiped engine does not work after Init: %v", err)
+	}
+}
+
+func TestTnt2Engine_Processed(t *testing.T) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	plaintext := make([]byte, 5*CipherBlockBytes+9)
+	start := big.NewInt(100)
+	tnt2Machine.SetIndex(start)
+	ciphertext, err := runMachine(&tnt2Machine, "E", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks, bytes := tnt2Machine.Processed(); blocks != 6 || bytes != uint64(len(plaintext)) {
+		t.Errorf("Tnt2Engine.Processed() after encryption = %d, %d, want 6, %d", blocks, bytes, len(plaintext))
+	}
+	// Decrypt the ciphertext in pieces, using the engine to track the position.
+	tnt2Machine.SetIndex(start)
+	tnt2Machine.SetEngineType("D")
+	tnt2Machine.BuildCipherMachine()
+	for i, blk := range makeBlocks(ciphertext) {
+		tnt2Machine.Left() <- blk
+		<-tnt2Machine.Right()
+		if got := tnt2Machine.Index(); got.Cmp(big.NewInt(int64(101+i))) != 0 {
+			t.Errorf("Tnt2Engine.Index() after decrypting block %d = %s, want %d", i, got, 101+i)
+		}
+	}
+	tnt2Machine.CloseCipherMachine()
+	if blocks, bytes := tnt2Machine.Processed(); blocks != 6 || bytes != uint64(len(plaintext)) {
+		t.Errorf("Tnt2Engine.Processed() after decryption = %d, %d, want 6, %d", blocks, bytes, len(plaintext))
+	}
+	tnt2Machine.SetIndex(start)
+	if blocks, bytes := tnt2Machine.Processed(); blocks != 0 || bytes != 0 {
+		t.Errorf("Tnt2Engine.Processed() after SetIndex = %d, %d, want 0, 0", blocks, bytes)
+	}
+	if blocks, bytes := new(Tnt2Engine).Processed(); blocks != 0 || bytes != 0 {
+		t.Errorf("Tnt2Engine.Processed() of an empty engine = %d, %d, want 0, 0", blocks, bytes)
+	}
+}
+
 func TestTnt2Engine_SetIndex(t *testing.T) {
 	var tnt2Machine Tnt2Engine
 	tnt2Machine.Init([]byte("SecretKey"), "")
@@ -914,3 +1141,49 @@ func BenchmarkGetRotorBlock(b *testing.B) {
 		blk = rotor.getRotorBlock(len(blk))
 	}
 }
+
+func BenchmarkRotorApplyFTo(b *testing.B) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	tnt2Machine.SetIndex(BigZero)
+	rotor := tnt2Machine.engine[0].(*Rotor)
+	blk := make(CipherBlock, CipherBlockBytes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rotor.ApplyFTo(blk, blk)
+	}
+}
+
+func BenchmarkEngineBlock(b *testing.B) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	tnt2Machine.SetEngineType("E")
+	tnt2Machine.SetIndex(BigZero)
+	tnt2Machine.BuildCipherMachine()
+	defer tnt2Machine.CloseCipherMachine()
+	left, right := tnt2Machine.Left(), tnt2Machine.Right()
+	blk := make(CipherBlock, CipherBlockBytes)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		left <- blk
+		blk = <-right
+	}
+}
+
+func BenchmarkTnt2Engine_SetIndex(b *testing.B) {
+	var tnt2Machine Tnt2Engine
+	tnt2Machine.Init([]byte("SecretKey"), "")
+	b.Run("uint64", func(b *testing.B) {
+		idx := big.NewInt(1234567890)
+		for i := 0; i < b.N; i++ {
+			tnt2Machine.SetIndex(idx)
+		}
+	})
+	b.Run("big", func(b *testing.B) {
+		idx, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+		for i := 0; i < b.N; i++ {
+			tnt2Machine.SetIndex(idx)
+		}
+	})
+}